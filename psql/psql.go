@@ -6,16 +6,20 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"strconv"
 	"strings"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/dosco/super-graph/qcode"
 	"github.com/dosco/super-graph/util"
+	"github.com/gobuffalo/flect"
 )
 
 const (
-	empty      = ""
-	closeBlock = 500
+	empty = ""
+
+	// added to a select id to mark the end of it's block
+	closeBlock = 1 << 24
 )
 
 type Config struct {
@@ -32,6 +36,10 @@ func NewCompiler(conf Config) *Compiler {
 	return &Compiler{conf.Schema, conf.Vars}
 }
 
+func (c *Compiler) Schema() *DBSchema {
+	return c.schema
+}
+
 func (c *Compiler) AddRelationship(child, parent string, rel *DBRel) error {
 	return c.schema.SetRel(child, parent, rel)
 }
@@ -45,24 +53,62 @@ func (c *Compiler) IDColumn(table string) (string, error) {
 	return t.PrimaryCol, nil
 }
 
+func (c *Compiler) TableName(table string) (string, error) {
+	t, err := c.schema.GetTable(table)
+	if err != nil {
+		return empty, err
+	}
+
+	return t.Name, nil
+}
+
+// FieldType returns the graphql type name for the table and if a
+// field using it returns a list
+func (c *Compiler) FieldType(table string) (string, bool, error) {
+	t, err := c.schema.GetTable(table)
+	if err != nil {
+		return empty, false, err
+	}
+
+	return flect.Pascalize(flect.Singularize(t.Name)), !t.Singular, nil
+}
+
+type SkipType uint8
+
+const (
+	SkipNone SkipType = iota
+	SkipRemote
+	SkipNoRel
+)
+
+// Skip is set for each select left out of the sql by Compile, remote
+// selects have the json key in the parent that holds their id
+type Skip struct {
+	Type  SkipType
+	IDKey []byte
+}
+
 type compilerContext struct {
-	w *bytes.Buffer
-	s []qcode.Select
+	w    *bytes.Buffer
+	s    []qcode.Select
+	skip []Skip
 	*Compiler
 }
 
-func (co *Compiler) CompileEx(qc *qcode.QCode) (uint32, []byte, error) {
+func (co *Compiler) CompileEx(qc *qcode.QCode) ([]Skip, []byte, error) {
 	w := &bytes.Buffer{}
-	skipped, err := co.Compile(qc, w)
-	return skipped, w.Bytes(), err
+	skip, err := co.Compile(qc, w)
+	return skip, w.Bytes(), err
 }
 
-func (co *Compiler) Compile(qc *qcode.QCode, w *bytes.Buffer) (uint32, error) {
+// Compile writes the sql for the query and returns a Skip for each
+// select indexed by it's id
+func (co *Compiler) Compile(qc *qcode.QCode, w *bytes.Buffer) ([]Skip, error) {
 	if len(qc.Query.Selects) == 0 {
-		return 0, errors.New("empty query")
+		return nil, errors.New("empty query")
 	}
 
-	c := &compilerContext{w, qc.Query.Selects, co}
+	c := &compilerContext{w, qc.Query.Selects, make([]Skip, len(qc.Query.Selects)), co}
 	root := &qc.Query.Selects[0]
 
 	st := NewStack()
@@ -77,8 +123,6 @@ func (co *Compiler) Compile(qc *qcode.QCode, w *bytes.Buffer) (uint32, error) {
 	c.w.WriteString(root.Table)
 	c.w.WriteString(`) FROM (`)
 
-	var ignored uint32
-
 	for {
 		if st.Len() == 0 {
 			break
@@ -91,22 +135,20 @@ func (co *Compiler) Compile(qc *qcode.QCode, w *bytes.Buffer) (uint32, error) {
 
 			ti, err := c.schema.GetTable(sel.Table)
 			if err != nil {
-				return 0, err
+				return nil, err
 			}
 
 			if sel.ID != 0 {
 				if err = c.renderJoin(sel); err != nil {
-					return 0, err
+					return nil, err
 				}
 			}
-			skipped, err := c.renderSelect(sel, ti)
-			if err != nil {
-				return 0, err
+			if err = c.renderSelect(sel, ti); err != nil {
+				return nil, err
 			}
-			ignored |= skipped
 
 			for _, cid := range sel.Children {
-				if hasBit(skipped, uint32(cid)) {
+				if c.skip[cid].Type != SkipNone {
 					continue
 				}
 				child := &c.s[cid]
@@ -120,17 +162,17 @@ func (co *Compiler) Compile(qc *qcode.QCode, w *bytes.Buffer) (uint32, error) {
 
 			ti, err := c.schema.GetTable(sel.Table)
 			if err != nil {
-				return 0, err
+				return nil, err
 			}
 
 			err = c.renderSelectClose(sel, ti)
 			if err != nil {
-				return 0, err
+				return nil, err
 			}
 
 			if sel.ID != 0 {
 				if err = c.renderJoinClose(sel); err != nil {
-					return 0, err
+					return nil, err
 				}
 			}
 		}
@@ -140,12 +182,10 @@ func (co *Compiler) Compile(qc *qcode.QCode, w *bytes.Buffer) (uint32, error) {
 	alias(c.w, `done_1337`)
 	c.w.WriteString(`;`)
 
-	return ignored, nil
+	return c.skip, nil
 }
 
-func (c *compilerContext) processChildren(sel *qcode.Select, ti *DBTableInfo) (uint32, []*qcode.Column) {
-	var skipped uint32
-
+func (c *compilerContext) processChildren(sel *qcode.Select, ti *DBTableInfo) []*qcode.Column {
 	cols := make([]*qcode.Column, 0, len(sel.Cols))
 	colmap := make(map[string]struct{}, len(sel.Cols))
 
@@ -158,7 +198,7 @@ func (c *compilerContext) processChildren(sel *qcode.Select, ti *DBTableInfo) (u
 
 		rel, err := c.schema.GetRel(child.Table, ti.Name)
 		if err != nil {
-			skipped |= (1 << uint(id))
+			c.skip[id].Type = SkipNoRel
 			continue
 		}
 
@@ -177,18 +217,24 @@ func (c *compilerContext) processChildren(sel *qcode.Select, ti *DBTableInfo) (u
 			if _, ok := colmap[rel.Col1]; !ok {
 				cols = append(cols, &qcode.Column{sel.Table, rel.Col1, rel.Col2})
 			}
-			skipped |= (1 << uint(id))
+			for _, cn := range rel.Cols {
+				if _, ok := colmap[cn]; !ok {
+					cols = append(cols, &qcode.Column{Table: sel.Table, Name: cn, FieldName: cn})
+					colmap[cn] = struct{}{}
+				}
+			}
+			c.skip[id] = Skip{SkipRemote, remoteIDKey(rel, id)}
 
 		default:
-			skipped |= (1 << uint(id))
+			c.skip[id].Type = SkipNoRel
 		}
 	}
 
-	return skipped, cols
+	return cols
 }
 
-func (c *compilerContext) renderSelect(sel *qcode.Select, ti *DBTableInfo) (uint32, error) {
-	skipped, childCols := c.processChildren(sel, ti)
+func (c *compilerContext) renderSelect(sel *qcode.Select, ti *DBTableInfo) error {
+	childCols := c.processChildren(sel, ti)
 	hasOrder := len(sel.OrderBy) != 0
 
 	// SELECT
@@ -201,7 +247,7 @@ func (c *compilerContext) renderSelect(sel *qcode.Select, ti *DBTableInfo) (uint
 		if hasOrder {
 			err := c.renderOrderBy(sel)
 			if err != nil {
-				return skipped, err
+				return err
 			}
 		}
 
@@ -230,9 +276,9 @@ func (c *compilerContext) renderSelect(sel *qcode.Select, ti *DBTableInfo) (uint
 
 	c.renderRemoteRelColumns(sel)
 
-	err := c.renderJoinedColumns(sel, skipped)
+	err := c.renderJoinedColumns(sel)
 	if err != nil {
-		return skipped, err
+		return err
 	}
 
 	//fmt.Fprintf(w, `) AS "sel_%d"`, c.sel.ID)
@@ -250,13 +296,13 @@ func (c *compilerContext) renderSelect(sel *qcode.Select, ti *DBTableInfo) (uint
 	// END-SELECT
 
 	// FROM (SELECT .... )
-	err = c.renderBaseSelect(sel, ti, childCols, skipped)
+	err = c.renderBaseSelect(sel, ti, childCols)
 	if err != nil {
-		return skipped, err
+		return err
 	}
 	// END-FROM
 
-	return skipped, nil
+	return nil
 }
 
 func (c *compilerContext) renderSelectClose(sel *qcode.Select, ti *DBTableInfo) error {
@@ -363,19 +409,48 @@ func (c *compilerContext) renderRemoteRelColumns(sel *qcode.Select) {
 		if i != 0 || len(sel.Cols) != 0 {
 			io.WriteString(c.w, ", ")
 		}
-		//fmt.Fprintf(w, `"%s_%d"."%s" AS "%s"`,
-		//c.sel.Table, c.sel.ID, rel.Col1, rel.Col2)
-		colWithTableID(c.w, sel.Table, sel.ID, rel.Col1)
-		alias(c.w, rel.Col2)
+		//fmt.Fprintf(w, `"%s_%d"."%s" AS "%s_%d"`,
+		//c.sel.Table, c.sel.ID, rel.Col1, rel.Col2, child.ID)
+		if len(rel.Cols) == 0 {
+			colWithTableID(c.w, sel.Table, sel.ID, rel.Col1)
+		} else {
+			c.renderRemoteRelObject(sel, rel)
+		}
+		alias(c.w, string(c.skip[id].IDKey))
 		i++
 	}
 }
 
-func (c *compilerContext) renderJoinedColumns(sel *qcode.Select, skipped uint32) error {
+// renderRemoteRelObject renders the columns sent to a remote as
+// a json object with the column names as keys
+func (c *compilerContext) renderRemoteRelObject(sel *qcode.Select, rel *DBRel) {
+	//fmt.Fprintf(w, `json_build_object('%s', "%s_%d"."%s", ...)`,
+	//rel.Col1, c.sel.Table, c.sel.ID, rel.Col1, ...)
+	c.w.WriteString(`json_build_object('`)
+	c.w.WriteString(rel.Col1)
+	c.w.WriteString(`', `)
+	colWithTableID(c.w, sel.Table, sel.ID, rel.Col1)
+
+	for _, cn := range rel.Cols {
+		c.w.WriteString(`, '`)
+		c.w.WriteString(cn)
+		c.w.WriteString(`', `)
+		colWithTableID(c.w, sel.Table, sel.ID, cn)
+	}
+	c.w.WriteString(`)`)
+}
+
+// remoteIDKey is unique for each remote select so the same remote
+// can be used at more than one place in a query
+func remoteIDKey(rel *DBRel, id int32) []byte {
+	return []byte(rel.Col2 + "_" + strconv.Itoa(int(id)))
+}
+
+func (c *compilerContext) renderJoinedColumns(sel *qcode.Select) error {
 	colsRendered := len(sel.Cols) != 0
 
 	for _, id := range sel.Children {
-		skipThis := hasBit(skipped, uint32(id))
+		skipThis := c.skip[id].Type != SkipNone
 
 		if colsRendered && !skipThis {
 			io.WriteString(c.w, ", ")
@@ -394,7 +469,7 @@ func (c *compilerContext) renderJoinedColumns(sel *qcode.Select, skipped uint32)
 }
 
 func (c *compilerContext) renderBaseSelect(sel *qcode.Select, ti *DBTableInfo,
-	childCols []*qcode.Column, skipped uint32) error {
+	childCols []*qcode.Column) error {
 	var groupBy []int
 
 	isRoot := sel.ID == 0
@@ -897,11 +972,6 @@ func funcPrefixLen(fn string) int {
 	return 0
 }
 
-func hasBit(n uint32, pos uint32) bool {
-	val := n & (1 << pos)
-	return (val > 0)
-}
-
 func alias(w *bytes.Buffer, alias string) {
 	w.WriteString(` AS "`)
 	w.WriteString(alias)
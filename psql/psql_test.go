@@ -2,6 +2,7 @@ package psql
 
 import (
 	"bytes"
+	"fmt"
 	"log"
 	"os"
 	"testing"
@@ -465,6 +466,81 @@ func syntheticTables(t *testing.T) {
 	}
 }
 
+func remoteJoin(t *testing.T) {
+	err := pcompile.AddRelationship("payments", "customers", &DBRel{
+		Type: RelRemote,
+		Col1: "id",
+		Col2: "__customers_id",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// children are compiled last to first so this pushes the
+	// remote select past the 32nd select
+	var gql bytes.Buffer
+
+	gql.WriteString(`query { customers { id payments { amount } `)
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&gql, `p%d: purchases { id } `, i)
+	}
+	gql.WriteString(`} }`)
+
+	qcomp, err := qcode.NewCompiler(qcode.Config{MaxSelects: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qc, err := qcomp.Compile(gql.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	skip, resSQL, err := pcompile.CompileEx(qc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if skip[41].Type != SkipRemote || string(skip[41].IDKey) != "__customers_id_41" {
+		t.Fatalf("expecting a remote skip for select 41 got %v", skip[41])
+	}
+
+	for i := 1; i < 41; i++ {
+		if skip[i].Type != SkipNone {
+			t.Fatalf("expecting select %d to not be skipped", i)
+		}
+	}
+
+	if !bytes.Contains(resSQL, []byte(`"customers_0"."id" AS "__customers_id_41"`)) {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func remoteJoinCols(t *testing.T) {
+	err := pcompile.AddRelationship("invoices", "customers", &DBRel{
+		Type: RelRemote,
+		Col1: "id",
+		Col2: "__customers_id",
+		Cols: []string{"email"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gql := `query { customers { id invoices { amount } } }`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sql := `json_build_object('id', "customers_0"."id", 'email', "customers_0"."email") AS "__customers_id_1"`
+
+	if !bytes.Contains(resSQL, []byte(sql)) {
+		t.Fatal(errNotExpected)
+	}
+}
+
 func TestCompileGQL(t *testing.T) {
 	t.Run("withComplexArgs", withComplexArgs)
 	t.Run("withWhereAndList", withWhereAndList)
@@ -480,6 +556,8 @@ func TestCompileGQL(t *testing.T) {
 	t.Run("aggFunctionWithFilter", aggFunctionWithFilter)
 	t.Run("queryWithVariables", queryWithVariables)
 	t.Run("syntheticTables", syntheticTables)
+	t.Run("remoteJoin", remoteJoin)
+	t.Run("remoteJoinCols", remoteJoinCols)
 }
 
 var benchGQL = []byte(`query {
@@ -122,12 +122,29 @@ const (
 	RelRemote
 )
 
+func (rt RelType) String() string {
+	switch rt {
+	case RelBelongTo:
+		return "belongs_to"
+	case RelOneToMany:
+		return "one_to_many"
+	case RelOneToManyThrough:
+		return "one_to_many_through"
+	case RelRemote:
+		return "remote"
+	}
+	return "unknown"
+}
+
 type DBRel struct {
 	Type    RelType
 	Through string
 	ColT    string
 	Col1    string
 	Col2    string
+
+	// other columns sent along with Col1 to a remote
+	Cols []string
 }
 
 func NewDBSchema(db *pg.DB, aliases map[string][]string) (*DBSchema, error) {
@@ -224,12 +241,12 @@ func (s *DBSchema) updateSchema(
 
 			// Belongs-to relation between current table and the
 			// table in the foreign key
-			rel1 := &DBRel{RelBelongTo, "", "", c.Name, fc.Name}
+			rel1 := &DBRel{RelBelongTo, "", "", c.Name, fc.Name, nil}
 			s.SetRel(ct, ft, rel1)
 
 			// One-to-many relation between the foreign key table and the
 			// the current table
-			rel2 := &DBRel{RelOneToMany, "", "", fc.Name, c.Name}
+			rel2 := &DBRel{RelOneToMany, "", "", fc.Name, c.Name, nil}
 			s.SetRel(ft, ct, rel2)
 
 			jcols = append(jcols, c)
@@ -273,13 +290,13 @@ func (s *DBSchema) updateSchemaOTMT(
 	// One-to-many-through relation between 1nd foreign key table and the
 	// 2nd foreign key table
 	//rel1 := &DBRel{RelOneToManyThrough, ct, fc1.Name, col1.Name}
-	rel1 := &DBRel{RelOneToManyThrough, ct, col2.Name, fc2.Name, col1.Name}
+	rel1 := &DBRel{RelOneToManyThrough, ct, col2.Name, fc2.Name, col1.Name, nil}
 	s.SetRel(t1, t2, rel1)
 
 	// One-to-many-through relation between 2nd foreign key table and the
 	// 1nd foreign key table
 	//rel2 := &DBRel{RelOneToManyThrough, ct, col2.Name, fc2.Name}
-	rel2 := &DBRel{RelOneToManyThrough, ct, col1.Name, fc1.Name, col2.Name}
+	rel2 := &DBRel{RelOneToManyThrough, ct, col1.Name, fc1.Name, col2.Name, nil}
 	s.SetRel(t2, t1, rel2)
 }
 
@@ -323,6 +340,18 @@ func (s *DBSchema) GetRel(child, parent string) (*DBRel, error) {
 	return rel, nil
 }
 
+// Tables returns the tables by name, the singular, plural and alias
+// names of a table all point to the same table. It must not be changed.
+func (s *DBSchema) Tables() map[string]*DBTableInfo {
+	return s.t
+}
+
+// Rels returns the relationships by child and then parent table
+// name. It must not be changed.
+func (s *DBSchema) Rels() map[string]map[string]*DBRel {
+	return s.rm
+}
+
 func (s *DBSchema) IsAlias(name string) bool {
 	_, ok := s.al[name]
 	return ok
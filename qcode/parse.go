@@ -1,9 +1,11 @@
 package qcode
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"sync"
+	"unicode/utf8"
 	"unsafe"
 
 	"github.com/dosco/super-graph/util"
@@ -13,6 +15,33 @@ var (
 	errEOT = errors.New("end of tokens")
 )
 
+// Error is a query syntax error with it's position in the query
+type Error struct {
+	Message string
+	Line    int
+	Column  int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (line %d, column %d)", e.Message, e.Line, e.Column)
+}
+
+// errorAt returns the error with the line and column of the byte
+// position in the input
+func errorAt(input []byte, pos Pos, err error) error {
+	if int(pos) > len(input) {
+		pos = Pos(len(input))
+	}
+	b := input[:pos]
+	s := bytes.LastIndexByte(b, '\n') + 1
+
+	return &Error{
+		Message: err.Error(),
+		Line:    bytes.Count(b, []byte{'\n'}) + 1,
+		Column:  utf8.RuneCount(b[s:]) + 1,
+	}
+}
+
 type parserType int32
 
 const (
@@ -145,6 +174,10 @@ func parseSelectionSet(op *Operation, gql []byte) (*Operation, error) {
 	l.Reset()
 
 	if err = lex(l, gql); err != nil {
+		if n := len(l.items); n != 0 {
+			err = errorAt(l.input, l.items[n-1].pos, err)
+		}
+		lexPool.Put(l)
 		return nil, err
 	}
 
@@ -164,6 +197,11 @@ func parseSelectionSet(op *Operation, gql []byte) (*Operation, error) {
 		op.Fields, err = p.parseFields(op.Fields)
 	}
 
+	// the position is needed before the lexer items are reused
+	if err != nil {
+		err = p.errorAt(err)
+	}
+
 	lexPool.Put(l)
 
 	if err != nil {
@@ -173,6 +211,23 @@ func parseSelectionSet(op *Operation, gql []byte) (*Operation, error) {
 	return op, err
 }
 
+// errorAt adds the position of the token that failed to parse
+func (p *Parser) errorAt(err error) error {
+	if len(p.items) == 0 {
+		return err
+	}
+
+	n := p.pos + 1
+	if n >= len(p.items) {
+		n = len(p.items) - 1
+	}
+	if n < 0 {
+		n = 0
+	}
+
+	return errorAt(p.input, p.items[n].pos, err)
+}
+
 func (p *Parser) next() item {
 	n := p.pos + 1
 	if n >= len(p.items) {
@@ -77,6 +77,25 @@ func TestInvalidCompile2(t *testing.T) {
 	}
 }
 
+func TestCompileErrorPosition(t *testing.T) {
+	qcompile, _ := NewCompiler(Config{})
+	_, err := qcompile.CompileQuery([]byte(`{
+	products {
+		id
+		name(
+	}
+}`))
+
+	qerr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expecting a *Error got %T: %v", err, err)
+	}
+
+	if qerr.Line != 5 || qerr.Column != 2 {
+		t.Fatalf("expecting line 5, column 2 got line %d, column %d", qerr.Line, qerr.Column)
+	}
+}
+
 func TestEmptyCompile(t *testing.T) {
 	qcompile, _ := NewCompiler(Config{})
 	_, err := qcompile.CompileQuery([]byte(``))
@@ -138,3 +157,78 @@ func BenchmarkQCompileP(b *testing.B) {
 		}
 	})
 }
+
+func TestCompileCost(t *testing.T) {
+	qcompile, _ := NewCompiler(Config{})
+
+	qc, err := qcompile.CompileQuery([]byte(`
+	products(limit: 30) {
+		id
+		user {
+			id
+		}
+		customers {
+			id
+			purchases(limit: 5) {
+				id
+			}
+		}
+	}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 30 products + 30 users + (30 * 20) customers + (30 * 20 * 5) purchases
+	if qc.Query.Cost != 3660 {
+		t.Fatalf("Expecting cost 3660 got %d", qc.Query.Cost)
+	}
+
+	if qc.Query.Depth != 3 {
+		t.Fatalf("Expecting depth 3 got %d", qc.Query.Depth)
+	}
+
+	sel := qc.Query.Selects
+	for i := range sel {
+		switch sel[i].Table {
+		case "user", "customers":
+			if sel[sel[i].ParentID].Table != "products" {
+				t.Fatalf("Expecting parent of %s to be products got %s",
+					sel[i].Table, sel[sel[i].ParentID].Table)
+			}
+		}
+	}
+}
+
+func TestCompileLimits(t *testing.T) {
+	gql := []byte(`
+	products(limit: 30) {
+		id
+		customers {
+			id
+			purchases {
+				id
+			}
+		}
+	}`)
+
+	qcompile, _ := NewCompiler(Config{MaxDepth: 2})
+	if _, err := qcompile.CompileQuery(gql); err == nil {
+		t.Fatal(errors.New("expecting a depth limit error"))
+	}
+
+	qcompile, _ = NewCompiler(Config{MaxSelects: 2})
+	if _, err := qcompile.CompileQuery(gql); err == nil {
+		t.Fatal(errors.New("expecting a selector limit error"))
+	}
+
+	qcompile, _ = NewCompiler(Config{MaxCost: 1000})
+	if _, err := qcompile.CompileQuery(gql); err == nil {
+		t.Fatal(errors.New("expecting a cost limit error"))
+	}
+
+	qcompile, _ = NewCompiler(Config{MaxDepth: 3, MaxSelects: 3, MaxCost: 20000})
+	if _, err := qcompile.CompileQuery(gql); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,6 +3,7 @@ package qcode
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -12,6 +13,8 @@ import (
 
 const (
 	maxSelectors = 30
+	defaultLimit = 20
+	maxRows      = 1 << 30
 )
 
 type QCode struct {
@@ -20,6 +23,8 @@ type QCode struct {
 
 type Query struct {
 	Selects []Select
+	Depth   int
+	Cost    int
 }
 
 type Column struct {
@@ -140,6 +145,12 @@ type Config struct {
 	FilterMap     map[string][]string
 	Blacklist     []string
 	KeepArgs      bool
+
+	// Limits on the query, a zero value means the default is used
+	// for MaxSelects and no limit for MaxDepth and MaxCost
+	MaxDepth   int
+	MaxSelects int
+	MaxCost    int
 }
 
 type Compiler struct {
@@ -147,6 +158,9 @@ type Compiler struct {
 	fm map[string]*Exp
 	bl map[string]struct{}
 	ka bool
+	md int
+	ms int
+	mc int
 }
 
 var expPool = sync.Pool{
@@ -184,7 +198,12 @@ func NewCompiler(c Config) (*Compiler, error) {
 		expPool.Put(&seedExp[i])
 	}
 
-	return &Compiler{fl, fm, bl, c.KeepArgs}, nil
+	ms := c.MaxSelects
+	if ms <= 0 {
+		ms = maxSelectors
+	}
+
+	return &Compiler{fl, fm, bl, c.KeepArgs, c.MaxDepth, ms, c.MaxCost}, nil
 }
 
 func (com *Compiler) Compile(query []byte) (*QCode, error) {
@@ -222,6 +241,14 @@ func (com *Compiler) CompileQuery(query []byte) (*QCode, error) {
 		return nil, err
 	}
 
+	return com.CompileOperation(op)
+}
+
+// CompileOperation compiles a query parsed using ParseQuery, the
+// operation is reused once compiled so it can't be used again
+func (com *Compiler) CompileOperation(op *Operation) (*QCode, error) {
+	var err error
+
 	qc := &QCode{}
 	qc.Query, err = com.compileQuery(op)
 	opPool.Put(op)
@@ -235,11 +262,18 @@ func (com *Compiler) CompileQuery(query []byte) (*QCode, error) {
 
 func (com *Compiler) compileQuery(op *Operation) (*Query, error) {
 	id := int32(0)
-	parentID := int32(0)
 
 	selects := make([]Select, 0, 5)
 	st := NewStack()
 
+	// depth and number of rows fetched for each select
+	depth := make([]int, 0, 5)
+	rows := make([]int, 0, 5)
+	cost := 0
+
+	// field id to the id of the select created from it
+	fsmap := make(map[int32]int32)
+
 	if len(op.Fields) == 0 {
 		return nil, errors.New("empty query")
 	}
@@ -250,8 +284,8 @@ func (com *Compiler) compileQuery(op *Operation) (*Query, error) {
 			break
 		}
 
-		if id >= maxSelectors {
-			return nil, fmt.Errorf("selector limit reached (%d)", maxSelectors)
+		if int(id) >= com.ms {
+			return nil, fmt.Errorf("selector limit reached (%d)", com.ms)
 		}
 
 		fid := st.Pop()
@@ -263,11 +297,12 @@ func (com *Compiler) compileQuery(op *Operation) (*Query, error) {
 
 		selects = append(selects, Select{
 			ID:       id,
-			ParentID: parentID,
+			ParentID: fsmap[field.ParentID],
 			Table:    field.Name,
 			Children: make([]int32, 0, 5),
 		})
 		s := &selects[(len(selects) - 1)]
+		fsmap[field.ID] = s.ID
 
 		if s.ID != 0 {
 			p := &selects[s.ParentID]
@@ -295,7 +330,6 @@ func (com *Compiler) compileQuery(op *Operation) (*Query, error) {
 			}
 
 			if len(f.Children) != 0 {
-				parentID = s.ID
 				st.Push(f.ID)
 				continue
 			}
@@ -310,9 +344,37 @@ func (com *Compiler) compileQuery(op *Operation) (*Query, error) {
 			s.Cols = append(s.Cols, col)
 		}
 
+		// parents are always compiled before their children
+		if s.ID == 0 {
+			depth = append(depth, 1)
+			rows = append(rows, selectRows(s))
+		} else {
+			depth = append(depth, depth[s.ParentID]+1)
+			rows = append(rows, rows[s.ParentID]*selectRows(s))
+		}
+		if rows[s.ID] > maxRows {
+			rows[s.ID] = maxRows
+		}
+		cost += rows[s.ID]
+
+		if com.md > 0 && depth[s.ID] > com.md {
+			return nil, fmt.Errorf("query depth limit reached (%d)", com.md)
+		}
+
+		if com.mc > 0 && cost > com.mc {
+			return nil, fmt.Errorf("query cost limit reached (%d)", com.mc)
+		}
+
 		id++
 	}
 
+	maxDepth := 0
+	for i := range depth {
+		if depth[i] > maxDepth {
+			maxDepth = depth[i]
+		}
+	}
+
 	var ok bool
 	var fil *Exp
 
@@ -344,7 +406,27 @@ func (com *Compiler) compileQuery(op *Operation) (*Query, error) {
 		return nil, errors.New("invalid query")
 	}
 
-	return &Query{selects[:id]}, nil
+	return &Query{Selects: selects[:id], Depth: maxDepth, Cost: cost}, nil
+}
+
+// selectRows estimates the number of rows a select can return
+// for each row of its parent
+func selectRows(sel *Select) int {
+	if sel.Where != nil && sel.Where.Op == OpEqID {
+		return 1
+	}
+
+	if len(sel.Paging.Limit) != 0 {
+		if n, err := strconv.Atoi(sel.Paging.Limit); err == nil && n > 0 {
+			return n
+		}
+	}
+
+	if flect.Singularize(sel.Table) == sel.Table {
+		return 1
+	}
+
+	return defaultLimit
 }
 
 func (com *Compiler) compileArgs(sel *Select, args []Arg) error {
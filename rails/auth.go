@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 
 	"github.com/Masterminds/semver"
 	"github.com/adjust/gorails/marshal"
@@ -15,14 +16,19 @@ const (
 	authSalt      = "authenticated encrypted cookie"
 	railsCipher   = "aes-256-cbc"
 	railsCipher52 = "aes-256-gcm"
+	railsDigest   = "sha1"
+	railsDigest7  = "sha256"
 )
 
 var (
-	errSessionData = errors.New("error decoding session data")
+	errSessionData   = errors.New("error decoding session data")
+	errCookieExpired = errors.New("rails cookie has expired")
+	errNoUser        = errors.New("no user found in session data")
 )
 
 type Auth struct {
 	Cipher   string
+	Digest   string
 	Secret   string
 	Salt     string
 	SignSalt string
@@ -31,6 +37,7 @@ type Auth struct {
 
 func NewAuth(version, secret string) (*Auth, error) {
 	ra := &Auth{
+		Digest:   railsDigest,
 		Secret:   secret,
 		Salt:     salt,
 		SignSalt: signSalt,
@@ -47,12 +54,22 @@ func NewAuth(version, secret string) (*Auth, error) {
 		return nil, fmt.Errorf("rails auth: %s", err)
 	}
 
+	gt7, err := semver.NewConstraint(">= 7.0")
+	if err != nil {
+		return nil, fmt.Errorf("rails auth: %s", err)
+	}
+
 	if gt52.Check(ver) {
 		ra.Cipher = railsCipher52
 	} else {
 		ra.Cipher = railsCipher
 	}
 
+	// Rails 7 derives the cookie encryption key using SHA256
+	if gt7.Check(ver) {
+		ra.Digest = railsDigest7
+	}
+
 	return ra, nil
 }
 
@@ -64,7 +81,7 @@ func (ra *Auth) ParseCookie(cookie string) (userID string, err error) {
 		dcookie, err = parseCookie(cookie, ra.Secret, ra.Salt, ra.SignSalt)
 
 	case railsCipher52:
-		dcookie, err = parseCookie52(cookie, ra.Secret, ra.AuthSalt)
+		dcookie, err = parseCookie52(cookie, ra.Secret, ra.AuthSalt, ra.Digest)
 
 	default:
 		err = fmt.Errorf("unknown rails cookie cipher '%s'", ra.Cipher)
@@ -74,16 +91,30 @@ func (ra *Auth) ParseCookie(cookie string) (userID string, err error) {
 		return
 	}
 
+	if len(dcookie) == 0 {
+		err = errSessionData
+		return
+	}
+
 	if dcookie[0] != '{' {
 		userID, err = getUserId4(dcookie)
-	} else {
-		userID, err = getUserId(dcookie)
+		return
 	}
 
+	// Rails 6 and above wrap the session in a metadata envelope
+	if dcookie, err = parseMessage(dcookie); err != nil {
+		return
+	}
+
+	userID, err = getUserId(dcookie)
 	return
 }
 
 func ParseCookie(cookie string) (string, error) {
+	if len(cookie) == 0 {
+		return "", errSessionData
+	}
+
 	if cookie[0] != '{' {
 		return getUserId4([]byte(cookie))
 	}
@@ -99,36 +130,43 @@ func getUserId(data []byte) (userID string, err error) {
 		return
 	}
 
-	userKey, ok := sessionData["warden.user.user.key"]
-	if !ok {
-		err = errors.New("key 'warden.user.user.key' not found in session data")
-	}
+	// Devise / Warden session
+	if userKey, ok := sessionData["warden.user.user.key"]; ok {
+		items, ok := userKey.([]interface{})
+		if !ok || len(items) != 2 {
+			err = errSessionData
+			return
+		}
 
-	items, ok := userKey.([]interface{})
-	if !ok {
-		err = errSessionData
-		return
-	}
+		uids, ok := items[0].([]interface{})
+		if !ok || len(uids) == 0 {
+			err = errSessionData
+			return
+		}
 
-	if len(items) != 2 {
-		err = errSessionData
-		return
+		return jsonUserID(uids[0])
 	}
 
-	uids, ok := items[0].([]interface{})
-	if !ok {
-		err = errSessionData
-		return
+	// Plain session without Devise eg. session[:user_id] = user.id
+	if uid, ok := sessionData["user_id"]; ok {
+		return jsonUserID(uid)
 	}
 
-	uid, ok := uids[0].(float64)
-	if !ok {
-		err = errSessionData
-		return
+	err = errNoUser
+	return
+}
+
+func jsonUserID(v interface{}) (string, error) {
+	switch uid := v.(type) {
+	case float64:
+		return strconv.FormatInt(int64(uid), 10), nil
+	case string:
+		if len(uid) != 0 {
+			return uid, nil
+		}
 	}
-	userID = fmt.Sprintf("%d", int64(uid))
 
-	return
+	return "", errSessionData
 }
 
 func getUserId4(data []byte) (userID string, err error) {
@@ -139,7 +177,11 @@ func getUserId4(data []byte) (userID string, err error) {
 
 	wardenData, ok := sessionData["warden.user.user.key"]
 	if !ok {
-		err = errSessionData
+		if uid, ok := sessionData["user_id"]; ok {
+			return marshalUserID(uid)
+		}
+
+		err = errNoUser
 		return
 	}
 
@@ -161,11 +203,22 @@ func getUserId4(data []byte) (userID string, err error) {
 		return
 	}
 
-	uid, err := userData[0].GetAsInteger()
+	return marshalUserID(userData[0])
+}
+
+func marshalUserID(v *marshal.MarshalledObject) (string, error) {
+	if uid, err := v.GetAsInteger(); err == nil {
+		return strconv.FormatInt(uid, 10), nil
+	}
+
+	uid, err := v.GetAsString()
 	if err != nil {
-		return
+		return "", err
 	}
-	userID = fmt.Sprintf("%d", uid)
 
-	return
+	if len(uid) == 0 {
+		return "", errSessionData
+	}
+
+	return uid, nil
 }
@@ -77,3 +77,100 @@ func TestRailsMarshaledSession(t *testing.T) {
 		t.Errorf("Expecting userID 2 got %s", userID)
 	}
 }
+
+func TestRailsEncryptedSession6(t *testing.T) {
+	cookie :=
+		"TJ1RX9tjXQXPw5mpXI5omaFSlnfr2CsLM73JC6Z%2FkC3KQ1u%2BIgtI%2F9mBZQAICQ3jTb%2FT%2BDCoE1mBHvf6XlmtElr5xh2%2BLvSXFYG4t6doBCG6bGjOfnZJ0KgNLZ5v1eadLg6WMzuCYKcUP8k6qCVpLr4oq9cioc74oYPLJ2PaC3yA%2FuBjvCdrJ7nsQffXMQaJ0y4m0xfxnQn%2FN%2FxgcLIWcjbCXeWuPWIf9SUft1uDkwn3PV4tDwyZ2uN3V0J8U1hfwJoHVbvi6VkDgDgZG9HQzJD2KKIhb0zdyx45XEiSfG35W%2Fxg9%2FZFRcrWZbJk%2FvowREZLRij6ByllgyMSI4HMcIKozcscid3l4QvUL59%2BVNR%2F00PHbx7LPVAA3u9qk6DCHc10HWPT5rVm%2BQIG62amBxSxCG%2BnKWpI9ak%3D--214XQbe3wVB%2ByKNa--m1iVE7T8kYdqpdpx3DZhbw%3D%3D"
+
+	secret := "0a248500a64c01184edb4d7ad3a805488f8097ac761b76aaa6c17c01dcb7af03a2f18ba61b2868134b9c7b79a122bc0dadff4367414a2d173297bfea92be5566"
+
+	ra, err := NewAuth("6.0", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID, err := ra.ParseCookie(cookie)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if userID != "3" {
+		t.Errorf("Expecting userID 3 got %s", userID)
+	}
+}
+
+func TestRailsEncryptedSession7(t *testing.T) {
+	cookie :=
+		"hHolIZQJELBvpBLi0fKsnDv2myg9DDYFH4xhOcs4Cnl8nUU3OBfYOUGoOmra8GqOsBi3ncDJ2VVHqYDY%2FACli43xuLt9RX6%2FpCj45opR9AOnFDvirE1zilvzVvSByoKGbxusxPTcjDf6%2BbpAMSZ5mevxAfVpmJxbG8NW2M%2BqHpJkuRFsjDMiRQ0vh24gmoNsxNk36kQxTN%2FtIchQd8TQxg0zl8TKVcYRTCIdmlYnsRA7lYv8RHhBKF%2FJkCY2WmJKG%2FCwapJqRkWjG3nmGSW6hGTLD6mH27RA0xIPGy6uV25ZdZ9V--U5blyEXF5qCW%2BSFe--5%2Boiz6cfUgUzWXYf53TS2A%3D%3D"
+
+	secret := "0a248500a64c01184edb4d7ad3a805488f8097ac761b76aaa6c17c01dcb7af03a2f18ba61b2868134b9c7b79a122bc0dadff4367414a2d173297bfea92be5566"
+
+	ra, err := NewAuth("7.0", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID, err := ra.ParseCookie(cookie)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if userID != "4" {
+		t.Errorf("Expecting userID 4 got %s", userID)
+	}
+}
+
+func TestRailsEncryptedSession71(t *testing.T) {
+	cookie :=
+		"U2%2FoX9wXRGxEuWAgGddywyWmY1Ls8NKpnaSQvUTOGHHFRg1NfF8kmUPoWZhEt9wLmB7%2BL6YxCbOVqc3Y4QZv5hXepnjKgBDAANz67IFdbGPK0TRM7UBktHXDS9oOLgKYvyXljkKN%2FAQBcFpi6ZTzP5erAsC03cUdIH8vQYsDZEeG9Q34g5%2BrrHMxIj6zxkFqCCEOlMta2KUGSWsT2hk%3D--BoStVNkK0onuwCEc--G3h15b%2FwDQr6xR7m2Elq8A%3D%3D"
+
+	secret := "0a248500a64c01184edb4d7ad3a805488f8097ac761b76aaa6c17c01dcb7af03a2f18ba61b2868134b9c7b79a122bc0dadff4367414a2d173297bfea92be5566"
+
+	ra, err := NewAuth("7.1", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID, err := ra.ParseCookie(cookie)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if userID != "5" {
+		t.Errorf("Expecting userID 5 got %s", userID)
+	}
+}
+
+func TestRailsExpiredSession(t *testing.T) {
+	cookie :=
+		"cyG%2BXEej8BV0zk9Y6TRcgrXD12Jpf5Yf4Fo0b6NuEOMntnaCRs5zkdl0fNuyv%2Bdbn2mnOy1ZzTbFSOfiJ5942Kp%2BnNZCUxIMnC6a4hFOY%2FPPRgReyrfU5VpQNomATD4Rc23adN3kMExLQzM6nTOXB47YaawhmKTKdislIkSe%2BlnNriuUOwPgEVubxnScFWHtymlffI%2BruKFGX3DtSNzGZcefXyWys65RvBMQvG8wuh5LGkMm5pxr5bEWIPq7IJ1RgXDFUT3WQikATk1ms4qGxCE4UgeSZhzEbe%2F3%2Bdhyy4Y6fKv9sqqRpWeXx84AAb1yu3hfcvExImIrsSFhgAzcYZVGIemULRYsvcB2jYEuRDnq2ZvnZKncOk61bnSCcAeRdHK2rqT7CfLIed6WTJ1%2FRekpLusisbCmnRo%3D--LziK%2FEmO%2BE%2BHJxpu--8KVKNZi%2Bafh2SAb8BugieA%3D%3D"
+
+	secret := "0a248500a64c01184edb4d7ad3a805488f8097ac761b76aaa6c17c01dcb7af03a2f18ba61b2868134b9c7b79a122bc0dadff4367414a2d173297bfea92be5566"
+
+	ra, err := NewAuth("6.0", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ra.ParseCookie(cookie)
+	if err != errCookieExpired {
+		t.Errorf("Expecting error '%s' got '%v'", errCookieExpired, err)
+	}
+}
+
+func TestRailsJsonSessionUserID(t *testing.T) {
+	sessionData := `{"session_id":"7c4b2a9e0f1d4c3b8a6e5d2f1b0c9a87","user_id":7}`
+
+	userID, err := getUserId([]byte(sessionData))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if userID != "7" {
+		t.Errorf("Expecting userID 7 got %s", userID)
+	}
+}
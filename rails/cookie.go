@@ -4,9 +4,14 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/adjust/gorails/session"
 	"golang.org/x/crypto/pbkdf2"
@@ -22,31 +27,34 @@ func parseCookie(cookie, secretKeyBase, salt, signSalt string) ([]byte, error) {
 
 // {"session_id":"a71d6ffcd4ed5572ea2097f569eb95ef","warden.user.user.key":[[2],"$2a$11$q9Br7m4wJxQvF11hAHvTZO"],"_csrf_token":"HsYgrD2YBaWAabOYceN0hluNRnGuz49XiplmMPt43aY="}
 
-func parseCookie52(cookie, secretKeyBase, authSalt string) ([]byte, error) {
+func parseCookie52(cookie, secretKeyBase, authSalt, digest string) ([]byte, error) {
 	ecookie, err := url.QueryUnescape(cookie)
 	if err != nil {
 		return nil, err
 	}
 
 	vectors := strings.Split(ecookie, "--")
+	if len(vectors) != 3 {
+		return nil, errors.New("invalid rails cookie format")
+	}
 
-	body, err := base64.RawStdEncoding.DecodeString(vectors[0])
+	body, err := decodeBase64(vectors[0])
 	if err != nil {
 		return nil, err
 	}
 
-	iv, err := base64.RawStdEncoding.DecodeString(vectors[1])
+	iv, err := decodeBase64(vectors[1])
 	if err != nil {
 		return nil, err
 	}
 
-	tag, err := base64.StdEncoding.DecodeString(vectors[2])
+	tag, err := decodeBase64(vectors[2])
 	if err != nil {
 		return nil, err
 	}
 
 	key := pbkdf2.Key([]byte(secretKeyBase), []byte(authSalt),
-		1000, 32, sha1.New)
+		1000, 32, digestFn(digest))
 
 	c, err := aes.NewCipher(key)
 	if err != nil {
@@ -60,3 +68,57 @@ func parseCookie52(cookie, secretKeyBase, authSalt string) ([]byte, error) {
 
 	return gcm.Open(nil, iv, append(body, tag...), nil)
 }
+
+// {"_rails":{"message":"eyJzZXNzaW9uX2lkIjoiLi4uIn0=","exp":"2019-11-20T10:00:00.000Z","pur":"cookie._app_session"}}
+// {"_rails":{"data":{"session_id":"..."},"exp":null,"pur":"cookie._app_session"}}
+
+type railsMessage struct {
+	Rails *struct {
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+		Exp     *time.Time      `json:"exp"`
+		Pur     string          `json:"pur"`
+	} `json:"_rails"`
+}
+
+// parseMessage unwraps the purpose and expiry metadata envelope
+// added by Rails 6 and above. Data without the envelope is
+// returned as is.
+func parseMessage(data []byte) ([]byte, error) {
+	var msg railsMessage
+
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+
+	if msg.Rails == nil {
+		return data, nil
+	}
+
+	if msg.Rails.Exp != nil && time.Now().After(*msg.Rails.Exp) {
+		return nil, errCookieExpired
+	}
+
+	// Rails 7.1 inlines the session data in the envelope
+	if len(msg.Rails.Data) != 0 {
+		return msg.Rails.Data, nil
+	}
+
+	if len(msg.Rails.Message) == 0 {
+		return nil, errSessionData
+	}
+
+	return decodeBase64(msg.Rails.Message)
+}
+
+// decodeBase64 decodes both padded and unpadded base64 strings
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func digestFn(digest string) func() hash.Hash {
+	if digest == railsDigest7 {
+		return sha256.New
+	}
+	return sha1.New
+}
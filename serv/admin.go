@@ -0,0 +1,339 @@
+package serv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/dosco/super-graph/psql"
+)
+
+const (
+	readyTimeout = 2 * time.Second
+	redacted     = "[redacted]"
+)
+
+var (
+	errNoSchema = errors.New("database schema not loaded")
+)
+
+// health is ok as long as the process is up
+func health(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ready checks the database and rails session store can be reached
+// and that the database schema is loaded. It responds with a 503
+// when any of these fail so no requests are sent to this server.
+func (sg *SuperGraph) ready(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	checks := make(map[string]string)
+
+	check := func(name string, err error) {
+		if err == nil {
+			checks[name] = "ok"
+			return
+		}
+
+		sg.log.Warn().Err(err).Msgf("ready: %s check failed", name)
+		checks[name] = "failed"
+		status = http.StatusServiceUnavailable
+	}
+
+	_, err := sg.db.WithTimeout(readyTimeout).Exec("SELECT 1")
+	check("database", err)
+
+	if sg.sessions != nil {
+		check("session_store", sg.sessions.ping())
+	}
+
+	if pc := sg.current().pcompile; pc == nil || len(pc.Schema().Tables()) == 0 {
+		err = errNoSchema
+	} else {
+		err = nil
+	}
+
+	check("schema", err)
+
+	res := struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{"ok", checks}
+
+	if status != http.StatusOK {
+		res.Status = "unavailable"
+	}
+
+	writeJSON(w, status, res)
+}
+
+// adminGet only allows GET requests and passes the current snapshot so
+// the handler sees a consistent config, allow list and schema
+func (sg *SuperGraph) adminGet(next func(*snapshot) interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s := sg.acquire()
+		v := next(s)
+		s.release()
+
+		writeJSON(w, http.StatusOK, v)
+	}
+}
+
+func (sg *SuperGraph) adminConfig(s *snapshot) interface{} {
+	return redactConfig(s.conf)
+}
+
+func (sg *SuperGraph) adminAllowList(s *snapshot) interface{} {
+	al := s.allowList
+
+	al.Lock()
+	defer al.Unlock()
+
+	return allowListFmt{Queries: al.sorted()}
+}
+
+type adminPreparedItem struct {
+	Name string   `json:"name,omitempty"`
+	Hash string   `json:"hash"`
+	Role string   `json:"role,omitempty"`
+	Args []string `json:"args"`
+	SQL  string   `json:"sql"`
+}
+
+func (sg *SuperGraph) adminPrepared(s *snapshot) interface{} {
+	list := make([]adminPreparedItem, 0, len(s.preparedList))
+
+	for _, v := range s.preparedList {
+		list = append(list, adminPreparedItem{
+			Name: v.item.Name,
+			Hash: v.item.Hash,
+			Role: v.item.Role,
+			Args: v.args,
+			SQL:  v.sql,
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Hash < list[j].Hash
+	})
+
+	return map[string]interface{}{"prepared": list}
+}
+
+func (sg *SuperGraph) adminSlowQueries(*snapshot) interface{} {
+	return map[string]interface{}{"slow_queries": sg.slowLog.list()}
+}
+
+type adminTable struct {
+	Name       string         `json:"name"`
+	Names      []string       `json:"names"`
+	PrimaryKey string         `json:"primary_key,omitempty"`
+	TSVColumn  string         `json:"tsv_column,omitempty"`
+	Columns    []*adminColumn `json:"columns"`
+}
+
+type adminColumn struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	NotNull    bool   `json:"not_null,omitempty"`
+	PrimaryKey bool   `json:"primary_key,omitempty"`
+	ForeignKey string `json:"foreign_key,omitempty"`
+	id         int
+}
+
+type adminRel struct {
+	Child   string `json:"child"`
+	Parent  string `json:"parent"`
+	Type    string `json:"type"`
+	Through string `json:"through,omitempty"`
+	Col1    string `json:"col1"`
+	Col2    string `json:"col2"`
+}
+
+// adminSchema lists each table once with all the names it can be
+// queried by, and each relationship once
+func (sg *SuperGraph) adminSchema(s *snapshot) interface{} {
+	schema := s.pcompile.Schema()
+	tables := schema.Tables()
+
+	names := make([]string, 0, len(tables))
+	for k := range tables {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var tl []*adminTable
+	tm := make(map[string]*adminTable)
+
+	for _, k := range names {
+		ti := tables[k]
+
+		if t, ok := tm[ti.Name]; ok {
+			t.Names = append(t.Names, k)
+			continue
+		}
+
+		t := &adminTable{
+			Name:       ti.Name,
+			Names:      []string{k},
+			PrimaryKey: ti.PrimaryCol,
+			TSVColumn:  ti.TSVCol,
+		}
+
+		for _, c := range ti.Columns {
+			t.Columns = append(t.Columns, &adminColumn{
+				Name:       c.Name,
+				Type:       c.Type,
+				NotNull:    c.NotNull,
+				PrimaryKey: c.PrimaryKey,
+				ForeignKey: c.FKeyTable,
+				id:         c.ID,
+			})
+		}
+
+		sort.Slice(t.Columns, func(i, j int) bool {
+			return t.Columns[i].id < t.Columns[j].id
+		})
+
+		tm[ti.Name] = t
+		tl = append(tl, t)
+	}
+
+	sort.Slice(tl, func(i, j int) bool { return tl[i].Name < tl[j].Name })
+
+	rels := schema.Rels()
+
+	children := make([]string, 0, len(rels))
+	for k := range rels {
+		children = append(children, k)
+	}
+	sort.Strings(children)
+
+	var rl []adminRel
+	seen := make(map[*psql.DBRel]struct{})
+
+	for _, child := range children {
+		parents := make([]string, 0, len(rels[child]))
+		for k := range rels[child] {
+			parents = append(parents, k)
+		}
+		sort.Strings(parents)
+
+		for _, parent := range parents {
+			rel := rels[child][parent]
+
+			if _, ok := seen[rel]; ok {
+				continue
+			}
+			seen[rel] = struct{}{}
+
+			rl = append(rl, adminRel{
+				Child:   child,
+				Parent:  parent,
+				Type:    rel.Type.String(),
+				Through: rel.Through,
+				Col1:    rel.Col1,
+				Col2:    rel.Col2,
+			})
+		}
+	}
+
+	return map[string]interface{}{"tables": tl, "relationships": rl}
+}
+
+// redactConfig returns a copy of the config with the secrets,
+// passwords in urls and the values of headers sent to remotes
+// replaced
+func redactConfig(c *Config) Config {
+	rc := *c
+
+	rc.Admin.Secret = redact(rc.Admin.Secret)
+	rc.Auth.Rails.SecretKeyBase = redact(rc.Auth.Rails.SecretKeyBase)
+	rc.Auth.Rails.Password = redact(rc.Auth.Rails.Password)
+	rc.Auth.Rails.URL = redactURL(rc.Auth.Rails.URL)
+	rc.Auth.JWT.Secret = redact(rc.Auth.JWT.Secret)
+	rc.DB.Password = redact(rc.DB.Password)
+	rc.DB.Replicas = append([]ConfigReplica(nil), rc.DB.Replicas...)
+	for i := range rc.DB.Replicas {
+		rc.DB.Replicas[i].Password = redact(rc.DB.Replicas[i].Password)
+	}
+	rc.Cache.URL = redactURL(rc.Cache.URL)
+	rc.Telemetry.Endpoint = redactURL(rc.Telemetry.Endpoint)
+
+	rc.DB.Tables = redactTables(rc.DB.Tables)
+	rc.DB.Fields = redactTables(rc.DB.Fields)
+
+	return rc
+}
+
+func redactTables(tables []ConfigTable) []ConfigTable {
+	list := make([]ConfigTable, len(tables))
+
+	for i, t := range tables {
+		t.Remotes = append([]ConfigRemote(nil), t.Remotes...)
+
+		for n := range t.Remotes {
+			r := &t.Remotes[n]
+			r.URL = redactURL(r.URL)
+			r.BatchURL = redactURL(r.BatchURL)
+
+			r.SetHeaders = append(r.SetHeaders[:0:0], r.SetHeaders...)
+			for h := range r.SetHeaders {
+				r.SetHeaders[h].Value = redact(r.SetHeaders[h].Value)
+			}
+		}
+
+		list[i] = t
+	}
+
+	return list
+}
+
+func redact(s string) string {
+	if len(s) == 0 {
+		return s
+	}
+	return redacted
+}
+
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+
+	// it can't be known what part of it is a password
+	if err != nil {
+		return redacted
+	}
+
+	if u.User == nil {
+		return s
+	}
+
+	if _, ok := u.User.Password(); ok {
+		return u.Redacted()
+	}
+
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(v); err != nil {
+		logger.Error().Err(err).Msg("failed to encode response")
+	}
+}
@@ -0,0 +1,150 @@
+package serv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+type testSessionStore struct {
+	err error
+}
+
+func (s *testSessionStore) get(key string) ([]byte, error) { return nil, s.err }
+func (s *testSessionStore) ping() error                    { return s.err }
+
+func TestRedactConfig(t *testing.T) {
+	c := &Config{}
+	c.Admin.Secret = "secret"
+	c.DB.Password = "pwd"
+	c.DB.Replicas = []ConfigReplica{{Host: "replica1", Password: "pwd"}}
+	c.Auth.Rails.URL = "redis://:pwd@localhost:6379/0"
+	c.Cache.URL = "redis://localhost:6379"
+
+	r := ConfigRemote{Name: "payments", URL: "http://api/$id"}
+	r.SetHeaders = append(r.SetHeaders, struct {
+		Name  string
+		Value string
+	}{"Authorization", "Bearer token"})
+
+	c.DB.Tables = []ConfigTable{{Name: "users", Remotes: []ConfigRemote{r}}}
+
+	rc := redactConfig(c)
+
+	if rc.Admin.Secret != redacted || rc.DB.Password != redacted || rc.DB.Replicas[0].Password != redacted {
+		t.Error("expecting the secrets to be redacted")
+	}
+
+	if rc.Auth.Rails.URL != "redis://:xxxxx@localhost:6379/0" {
+		t.Errorf("expecting the url password to be redacted got %s", rc.Auth.Rails.URL)
+	}
+
+	if rc.Cache.URL != c.Cache.URL || rc.DB.Tables[0].Remotes[0].URL != "http://api/$id" {
+		t.Error("expecting urls without a password to be unchanged")
+	}
+
+	if rc.DB.Tables[0].Remotes[0].SetHeaders[0].Value != redacted {
+		t.Error("expecting the header values to be redacted")
+	}
+
+	if c.Admin.Secret != "secret" || c.DB.Replicas[0].Password != "pwd" || c.DB.Tables[0].Remotes[0].SetHeaders[0].Value != "Bearer token" {
+		t.Error("expecting the config to be unchanged")
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	// a redis cluster url does not parse
+	u := "redis-cluster://:secret@[::1]:6379,h2:6379"
+
+	if v := redactURL(u); v != redacted {
+		t.Errorf("expecting an unparseable url to be redacted got %s", v)
+	}
+
+	if v := redactURL(""); v != "" {
+		t.Errorf("expecting an empty url to be unchanged got %s", v)
+	}
+}
+
+func TestReady(t *testing.T) {
+	db := pg.Connect(&pg.Options{Addr: "localhost:1", DialTimeout: 100 * time.Millisecond})
+	defer db.Close()
+
+	sg := &SuperGraph{
+		log:      testLog(),
+		db:       db,
+		sessions: &testSessionStore{errors.New("connection refused")},
+	}
+	sg.snap.Store(&snapshot{refs: 1, conf: &Config{}})
+
+	w := httptest.NewRecorder()
+	sg.ready(w, httptest.NewRequest("GET", "/ready", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expecting a 503 got %d", w.Code)
+	}
+
+	var res struct {
+		Status string
+		Checks map[string]string
+	}
+
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []string{"database", "session_store", "schema"} {
+		if res.Checks[v] != "failed" {
+			t.Errorf("expecting the %s check to fail got '%s'", v, res.Checks[v])
+		}
+	}
+
+	w = httptest.NewRecorder()
+	health(w, httptest.NewRequest("GET", "/health", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expecting a 200 got %d", w.Code)
+	}
+}
+
+func TestAdminAllowList(t *testing.T) {
+	al := &allowList{list: map[string]*allowItem{
+		"b": {Name: "getUsers", Hash: "b", Query: "query getUsers { users { id } }"},
+		"a": {Name: "getProducts", Hash: "a", Query: "query getProducts { products { id } }"},
+	}}
+
+	sg := &SuperGraph{log: testLog()}
+	sg.snap.Store(&snapshot{refs: 1, conf: &Config{}, allowList: al})
+
+	h := withAdminAuth("secret", sg.adminGet(sg.adminAllowList))
+
+	r := httptest.NewRequest("POST", "/admin/allow_list", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expecting a 405 got %d", w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/admin/allow_list", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+
+	w = httptest.NewRecorder()
+	h(w, r)
+
+	var res allowListFmt
+
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Queries) != 2 || res.Queries[0].Name != "getProducts" {
+		t.Errorf("expecting the sorted allow list got %+v", res.Queries)
+	}
+}
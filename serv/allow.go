@@ -1,74 +1,144 @@
 package serv
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	allowListFile       = "allow.json"
+	legacyAllowListFile = "allow.list"
+
+	// shortest hash prefix accepted when removing queries
+	minHashPrefix = 7
+)
+
+var (
+	opNameRe = regexp.MustCompile(`^\s*(?:query|mutation)\s+([_A-Za-z][_0-9A-Za-z]*)`)
+	varRe    = regexp.MustCompile(`\$([_A-Za-z][_0-9A-Za-z]*)`)
+
+	// the allow lists of the old and new snapshot both save to the
+	// same file during a reload
+	writeMu sync.Mutex
 )
 
 type allowItem struct {
-	uri string
-	gql string
+	Name      string    `json:"name,omitempty"`
+	Hash      string    `json:"hash"`
+	URI       string    `json:"referer,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	Vars      []string  `json:"vars,omitempty"`
+
+	// restrict the query to a role, eg. 'user' for only
+	// authenticated requests
+	Role string `json:"role,omitempty"`
+
+	Query string `json:"query"`
 }
 
-var _allowList allowList
+// allowListFmt is the on disk format of the allow list, queries are
+// kept sorted by name and hash so the file diffs and merges cleanly
+type allowListFmt struct {
+	Queries []*allowItem `json:"queries"`
+}
 
 type allowList struct {
+	sync.Mutex
 	list     map[string]*allowItem
 	filepath string
 	saveChan chan *allowItem
+	log      *zerolog.Logger
 }
 
-func initAllowList(path string) {
-	_allowList = allowList{
+func initAllowList(path string, c *Config, log *zerolog.Logger) (*allowList, error) {
+	al := &allowList{
 		list:     make(map[string]*allowItem),
 		saveChan: make(chan *allowItem),
+		log:      log,
 	}
 
-	if len(path) != 0 {
-		fp := fmt.Sprintf("%s/allow.list", path)
+	fp, err := findAllowList(path)
 
-		if _, err := os.Stat(fp); err == nil {
-			_allowList.filepath = fp
-		} else if !os.IsNotExist(err) {
-			panic(err)
-		}
+	// without an allow list file queries are only kept in memory
+	if err != nil && !c.UseAllowList {
+		log.Warn().Err(err).Msg("queries used will not be saved")
+		fp, err = "", nil
 	}
 
-	if len(_allowList.filepath) == 0 {
-		fp := "./allow.list"
+	if err != nil {
+		return nil, err
+	}
+
+	legacy := false
 
-		if _, err := os.Stat(fp); err == nil {
-			_allowList.filepath = fp
-		} else if !os.IsNotExist(err) {
-			panic(err)
+	if len(fp) != 0 {
+		if legacy, err = al.read(fp); err != nil {
+			return nil, err
 		}
 	}
 
-	if len(_allowList.filepath) == 0 {
-		fp := "./config/allow.list"
+	// save the imported legacy allow list in the new format
+	if legacy {
+		log.Info().Msgf("imported legacy allow list %s", fp)
 
-		if _, err := os.Stat(fp); err == nil {
-			_allowList.filepath = fp
-		} else if !os.IsNotExist(err) {
-			panic(err)
+		if err := al.write(); err != nil {
+			return nil, err
 		}
 	}
 
-	if len(_allowList.filepath) == 0 {
-		panic("allow.list not found")
+	// saveChan is closed when the allow list is replaced on reload
+	go func() {
+		for v := range al.saveChan {
+			al.save(v)
+		}
+	}()
+
+	return al, nil
+}
+
+func findAllowList(path string) (string, error) {
+	dirs := []string{".", "./config"}
+
+	if len(path) != 0 {
+		dirs = append([]string{path}, dirs...)
 	}
 
-	_allowList.load()
+	for _, fn := range []string{allowListFile, legacyAllowListFile} {
+		for _, d := range dirs {
+			fp := filepath.Join(d, fn)
 
-	go func() {
-		for v := range _allowList.saveChan {
-			_allowList.save(v)
+			if _, err := os.Stat(fp); err == nil {
+				return fp, nil
+			} else if !os.IsNotExist(err) {
+				return "", err
+			}
 		}
-	}()
+	}
+
+	return "", fmt.Errorf("%s not found", allowListFile)
+}
+
+// read loads an allow list in either format, the older allow.list
+// format is imported and the filepath set to an allow.json next to it
+func (al *allowList) read(fp string) (bool, error) {
+	if filepath.Base(fp) == legacyAllowListFile {
+		al.filepath = filepath.Join(filepath.Dir(fp), allowListFile)
+		return true, al.loadLegacy(fp)
+	}
+
+	al.filepath = fp
+	return false, al.load()
 }
 
 func (al *allowList) add(req *gqlReq) {
@@ -76,35 +146,105 @@ func (al *allowList) add(req *gqlReq) {
 		return
 	}
 
-	al.saveChan <- &allowItem{
-		uri: req.ref,
-		gql: req.Query,
+	al.saveChan <- newAllowItem(req.OpName, req.ref, req.Query)
+}
+
+func newAllowItem(name, uri, gql string) *allowItem {
+	if len(name) == 0 {
+		if m := opNameRe.FindStringSubmatch(gql); m != nil {
+			name = m[1]
+		}
+	}
+
+	return &allowItem{
+		Name:      name,
+		Hash:      gqlHash([]byte(gql)),
+		URI:       uri,
+		FirstSeen: time.Now().UTC().Truncate(time.Second),
+		Vars:      queryVars(gql),
+		Query:     gql,
 	}
 }
 
-func (al *allowList) load() {
+// queryVars returns the sorted list of variables used in the query
+// that the client has to send
+func queryVars(gql string) []string {
+	var vars []string
+	seen := make(map[string]struct{})
+
+	for _, m := range varRe.FindAllStringSubmatch(gql, -1) {
+		if _, ok := seen[m[1]]; ok || serverVar(m[1]) {
+			continue
+		}
+		seen[m[1]] = struct{}{}
+		vars = append(vars, m[1])
+	}
+	sort.Strings(vars)
+
+	return vars
+}
+
+// serverVar returns true for the variables set from the authenticated
+// user, these are never taken from the request
+func serverVar(name string) bool {
+	switch strings.ToLower(name) {
+	case "user_id", "user_id_provider":
+		return true
+	}
+	return false
+}
+
+func (al *allowList) load() error {
 	b, err := ioutil.ReadFile(al.filepath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	if len(b) == 0 {
-		return
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil
+	}
+
+	var f allowListFmt
+
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("%s: %s", al.filepath, err)
+	}
+
+	for _, v := range f.Queries {
+		if len(v.Query) == 0 {
+			continue
+		}
+
+		// the query may have been edited by hand
+		v.Hash = gqlHash([]byte(v.Query))
+		al.list[v.Hash] = v
+	}
+
+	return nil
+}
+
+// loadLegacy reads the older allow.list format of '# uri' comments
+// followed by queries
+func (al *allowList) loadLegacy(fp string) error {
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return err
 	}
 
 	var uri string
 
 	s, e, c := 0, 0, 0
 
-	for {
+	for e < len(b) {
 		if c == 0 && b[e] == '#' {
 			s = e
-			for b[e] != '\n' && e < len(b) {
+			for e < len(b) && b[e] != '\n' {
 				e++
 			}
 			if (e - s) > 2 {
 				uri = strings.TrimSpace(string(b[(s + 1):e]))
 			}
+			continue
 		}
 		if b[e] == '{' {
 			if c == 0 {
@@ -114,52 +254,136 @@ func (al *allowList) load() {
 		} else if b[e] == '}' {
 			c--
 			if c == 0 {
-				q := b[s:(e + 1)]
-				al.list[gqlHash(q)] = &allowItem{
-					uri: uri,
-					gql: string(q),
-				}
+				item := newAllowItem("", uri, string(b[s:(e+1)]))
+				al.list[item.Hash] = item
 			}
 		}
-
 		e++
-		if e >= len(b) {
-			break
+	}
+
+	return nil
+}
+
+// remove deletes queries matching a hash, hash prefix or operation
+// name and returns the number of queries removed
+func (al *allowList) remove(key string) int {
+	al.Lock()
+	defer al.Unlock()
+
+	n := 0
+
+	for k, v := range al.list {
+		if v.Name == key || k == key ||
+			(len(key) >= minHashPrefix && strings.HasPrefix(k, key)) {
+			delete(al.list, k)
+			n++
+		}
+	}
+
+	return n
+}
+
+// merge adds queries from another allow list, for queries in both
+// the earliest first seen time is kept and any name, role or referer
+// set on only one of them
+func (al *allowList) merge(other *allowList) int {
+	al.Lock()
+	defer al.Unlock()
+
+	n := 0
+
+	for k, v := range other.list {
+		item, ok := al.list[k]
+		if !ok {
+			al.list[k] = v
+			n++
+			continue
+		}
+
+		if v.FirstSeen.Before(item.FirstSeen) {
+			item.FirstSeen = v.FirstSeen
+		}
+		if len(item.Name) == 0 {
+			item.Name = v.Name
+		}
+		if len(item.Role) == 0 {
+			item.Role = v.Role
+		}
+		if len(item.URI) == 0 {
+			item.URI = v.URI
 		}
 	}
+
+	return n
 }
 
 func (al *allowList) save(item *allowItem) {
-	al.list[gqlHash([]byte(item.gql))] = item
+	al.Lock()
+	_, ok := al.list[item.Hash]
+	if !ok {
+		al.list[item.Hash] = item
+	}
+	al.Unlock()
 
-	f, err := os.Create(al.filepath)
-	if err != nil {
-		logger.Warn().Err(err).Msg("Failed to write allow list to file")
+	// only new queries need to be written
+	if ok || len(al.filepath) == 0 {
 		return
 	}
 
-	defer f.Close()
+	if err := al.write(); err != nil {
+		al.log.Warn().Err(err).Msg("Failed to write allow list to file")
+	}
+}
 
-	keys := []string{}
-	urlMap := make(map[string][]string)
+// sorted returns the queries ordered by name and hash
+func (al *allowList) sorted() []*allowItem {
+	list := make([]*allowItem, 0, len(al.list))
 
 	for _, v := range al.list {
-		urlMap[v.uri] = append(urlMap[v.uri], v.gql)
+		list = append(list, v)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Hash < b.Hash
+	})
+
+	return list
+}
+
+// write saves the allow list to a temporary file first and then
+// moves it in place so a failed write never leaves a partial file
+func (al *allowList) write() error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	al.Lock()
+	b, err := al.marshal()
+	al.Unlock()
+
+	if err != nil {
+		return err
 	}
 
-	for k := range urlMap {
-		keys = append(keys, k)
+	tmp := al.filepath + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
 	}
-	sort.Strings(keys)
 
-	for i := range keys {
-		k := keys[i]
-		v := urlMap[k]
+	return os.Rename(tmp, al.filepath)
+}
 
-		f.WriteString(fmt.Sprintf("# %s\n\n", k))
+func (al *allowList) marshal() ([]byte, error) {
+	f := allowListFmt{Queries: al.sorted()}
 
-		for i := range v {
-			f.WriteString(fmt.Sprintf("query %s\n\n", v[i]))
-		}
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return nil, err
 	}
+
+	return append(b, '\n'), nil
 }
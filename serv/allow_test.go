@@ -0,0 +1,215 @@
+package serv
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var legacyAllowList = `# http://localhost:8080/
+
+query {
+  products(id: $PRODUCT_ID) {
+    name
+  }
+}
+
+# http://localhost:8080/users
+
+query {
+  me {
+    id
+  }
+}
+`
+
+func TestAllowListLegacyImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "allow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fp := filepath.Join(dir, legacyAllowListFile)
+
+	if err := ioutil.WriteFile(fp, []byte(legacyAllowList), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	al := &allowList{list: make(map[string]*allowItem)}
+
+	if err := al.loadLegacy(fp); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(al.list) != 2 {
+		t.Fatalf("Expecting 2 queries got %d", len(al.list))
+	}
+
+	al.filepath = filepath.Join(dir, allowListFile)
+
+	if err := al.write(); err != nil {
+		t.Fatal(err)
+	}
+
+	al1 := &allowList{list: make(map[string]*allowItem), filepath: al.filepath}
+
+	if err := al1.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(al.list, al1.list) {
+		t.Fatal("Expecting the same allow list after a save and load")
+	}
+
+	q := "{\n  products(id: $PRODUCT_ID) {\n    name\n  }\n}"
+	item, ok := al1.list[gqlHash([]byte(q))]
+
+	if !ok {
+		t.Fatal("Expecting query to be imported")
+	}
+
+	if item.URI != "http://localhost:8080/" {
+		t.Fatalf("Expecting referer 'http://localhost:8080/' got '%s'", item.URI)
+	}
+
+	if !reflect.DeepEqual(item.Vars, []string{"PRODUCT_ID"}) {
+		t.Fatalf("Expecting vars [PRODUCT_ID] got %v", item.Vars)
+	}
+}
+
+func TestAllowListStableOrder(t *testing.T) {
+	al := &allowList{list: make(map[string]*allowItem)}
+
+	for _, q := range []string{
+		"query getUsers { users { id } }",
+		"query getProducts { products { id } }",
+		"{ me { id } }",
+	} {
+		item := newAllowItem("", "", q)
+		al.list[item.Hash] = item
+	}
+
+	b1, err := al.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		b2, err := al.marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b1) != string(b2) {
+			t.Fatal("Expecting allow list to always be saved in the same order")
+		}
+	}
+
+	item := al.list[gqlHash([]byte("query getUsers { users { id } }"))]
+	if item.Name != "getUsers" {
+		t.Fatalf("Expecting operation name 'getUsers' got '%s'", item.Name)
+	}
+}
+
+func TestAllowListRemoveMerge(t *testing.T) {
+	al := &allowList{list: make(map[string]*allowItem)}
+	other := &allowList{list: make(map[string]*allowItem)}
+
+	q1 := newAllowItem("", "", "query getUsers { users { id } }")
+	q2 := newAllowItem("", "", "{ me { id } }")
+	al.list[q1.Hash] = q1
+	al.list[q2.Hash] = q2
+
+	q3 := newAllowItem("", "", "{ me { id } }")
+	q3.Role = roleUser
+	q3.FirstSeen = q2.FirstSeen.Add(-time.Hour)
+	q4 := newAllowItem("", "", "{ products { id } }")
+	other.list[q3.Hash] = q3
+	other.list[q4.Hash] = q4
+
+	if n := al.merge(other); n != 1 {
+		t.Fatalf("Expecting 1 query added got %d", n)
+	}
+
+	if len(al.list) != 3 {
+		t.Fatalf("Expecting 3 queries got %d", len(al.list))
+	}
+
+	if q2.Role != roleUser || !q2.FirstSeen.Equal(q3.FirstSeen) {
+		t.Fatal("Expecting role and earliest first seen to be merged")
+	}
+
+	if n := al.remove("getUsers"); n != 1 {
+		t.Fatalf("Expecting 1 query removed by name got %d", n)
+	}
+
+	if n := al.remove(q4.Hash[:minHashPrefix]); n != 1 {
+		t.Fatalf("Expecting 1 query removed by hash got %d", n)
+	}
+
+	if n := al.remove(q2.Hash[:3]); n != 0 {
+		t.Fatal("Expecting short hash prefixes to not match")
+	}
+
+	if len(al.list) != 1 {
+		t.Fatalf("Expecting 1 query got %d", len(al.list))
+	}
+}
+
+func TestAllowItemServerVars(t *testing.T) {
+	q := `query me { users(where: { id: { eq: $user_id } }) { id } }`
+
+	if item := newAllowItem("", "", q); len(item.Vars) != 0 {
+		t.Errorf("expecting no client variables got %v", item.Vars)
+	}
+
+	conf := &Config{}
+	conf.DB.vars = map[string][]byte{"account_id": []byte("(select 1)")}
+
+	c := &coreContext{
+		Context:  WithUserID(context.Background(), "5"),
+		snapshot: &snapshot{conf: conf},
+	}
+
+	// allow lists saved before these were left out
+	item := &allowItem{Query: q, Vars: []string{"account_id", "user_id"}}
+
+	if err := c.checkAllowItem(item); err != nil {
+		t.Errorf("expecting the server variables to not be required got %v", err)
+	}
+
+	item.Vars = append(item.Vars, "id")
+
+	if err := c.checkAllowItem(item); err == nil {
+		t.Error("expecting an error for a missing client variable")
+	}
+}
+
+func TestAllowItemRoleCached(t *testing.T) {
+	q := `query getProducts { products { id } }`
+	qh := gqlHash([]byte(q))
+
+	rc := &responseCache{store: newLRUCache(10)}
+
+	c := &coreContext{
+		Context:    context.Background(),
+		SuperGraph: &SuperGraph{log: testLog(), respCache: rc},
+		snapshot: &snapshot{
+			conf:         &Config{UseAllowList: true},
+			preparedList: map[string]*preparedItem{qh: {item: &allowItem{Role: roleUser}}},
+		},
+	}
+	c.req.Query = q
+
+	// the response cached for an authenticated user
+	rc.queries.Store(qh, &cachedQuery{})
+	rc.store.set(rc.key(c, qh, false), []byte(`{"products": []}`), nil, time.Minute)
+
+	if _, err := c.execQuery(nil); err != errUnauthorized {
+		t.Errorf("expecting anonymous requests to be unauthorized got %v", err)
+	}
+}
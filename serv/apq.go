@@ -0,0 +1,78 @@
+package serv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const (
+	maxPersistedQueries = 10000
+	persistedQueryTTL   = 24 * time.Hour
+
+	errPersistedQueryNotFound = "PersistedQueryNotFound"
+)
+
+var (
+	errPersistedQueryHash = errors.New("provided sha does not match query")
+	errPersistedQueryVer  = errors.New("unsupported persisted query version")
+)
+
+// Automatic persisted queries (APQ) map the sha256 hash of the
+// query text to the query. Clients first send just the hash and
+// if it's not found retry with both the hash and the query.
+func (sg *SuperGraph) initPersistedQueries(al *allowList) {
+	if sg.apqList == nil {
+		sg.apqList = newLRUCache(maxPersistedQueries)
+	}
+
+	// queries in the allow list can be used by their hash right away
+	for _, v := range al.list {
+		sg.apqList.set(apqHash(v.Query), []byte(v.Query), nil, persistedQueryTTL)
+	}
+}
+
+// resolvePersistedQuery sets the query text for requests that use
+// a persisted query hash. It returns false if the hash is unknown
+// and the client needs to send the query text.
+func (c *coreContext) resolvePersistedQuery() (bool, error) {
+	ext := c.req.Extensions
+	if ext == nil || ext.PersistedQuery == nil {
+		return true, nil
+	}
+	pq := ext.PersistedQuery
+
+	if pq.Version != 1 {
+		return false, withCode(errCodeBadRequest, errPersistedQueryVer)
+	}
+
+	if len(c.req.Query) == 0 {
+		q, ok := c.apqList.get(pq.Sha256Hash)
+		if !ok {
+			return false, nil
+		}
+		c.req.Query = string(q)
+		return true, nil
+	}
+
+	if apqHash(c.req.Query) != pq.Sha256Hash {
+		return false, withCode(errCodeBadRequest, errPersistedQueryHash)
+	}
+
+	// in production only queries already in the allow list can
+	// be registered
+	if c.conf.UseAllowList {
+		if _, ok := c.preparedList[gqlHash([]byte(c.req.Query))]; !ok {
+			return false, errNotAllowed
+		}
+	}
+
+	c.apqList.set(pq.Sha256Hash, []byte(c.req.Query), nil, persistedQueryTTL)
+	return true, nil
+}
+
+func apqHash(q string) string {
+	h := sha256.Sum256([]byte(q))
+	return hex.EncodeToString(h[:])
+}
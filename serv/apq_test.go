@@ -0,0 +1,45 @@
+package serv
+
+import (
+	"testing"
+)
+
+func TestPersistedQuery(t *testing.T) {
+	sg := &SuperGraph{
+		apqList: newLRUCache(maxPersistedQueries),
+	}
+
+	q := "query { products { id } }"
+	pq := &persistedQuery{Version: 1, Sha256Hash: apqHash(q)}
+
+	c := &coreContext{req: gqlReq{Extensions: &reqExtensions{pq}}, SuperGraph: sg,
+		snapshot: &snapshot{conf: &Config{}}}
+
+	if found, err := c.resolvePersistedQuery(); err != nil || found {
+		t.Fatal("Expecting persisted query to not be found")
+	}
+
+	c.req.Query = q
+
+	if found, err := c.resolvePersistedQuery(); err != nil || !found {
+		t.Fatal("Expecting persisted query to be registered")
+	}
+
+	c.req.Query = ""
+
+	if found, err := c.resolvePersistedQuery(); err != nil || !found {
+		t.Fatal("Expecting persisted query to be found")
+	}
+
+	if c.req.Query != q {
+		t.Fatalf("Expecting query '%s' got '%s'", q, c.req.Query)
+	}
+
+	c.req.Query = "query { users { id } }"
+
+	_, err := c.resolvePersistedQuery()
+
+	if ce, ok := err.(*codedError); !ok || ce.err != errPersistedQueryHash {
+		t.Fatal("Expecting hash mismatch error")
+	}
+}
@@ -4,14 +4,21 @@ import (
 	"context"
 	"net/http"
 	"strings"
+
+	"github.com/rs/zerolog"
 )
 
-var (
-	userIDProviderKey = struct{}{}
-	userIDKey         = struct{}{}
+type contextkey int
+
+// context keys need distinct values, struct{}{} keys are all equal
+const (
+	userIDProviderKey contextkey = iota + 1
+	userIDKey
+	rateLimitCtxKey
+	readPrimaryKey
 )
 
-func headerAuth(r *http.Request, c *config) *http.Request {
+func headerAuth(r *http.Request, c *Config) *http.Request {
 	if len(c.Auth.Header) == 0 {
 		return nil
 	}
@@ -25,25 +32,34 @@ func headerAuth(r *http.Request, c *config) *http.Request {
 	return nil
 }
 
-func withAuth(next http.HandlerFunc) http.HandlerFunc {
-	at := conf.Auth.Type
-	ru := conf.Auth.Rails.URL
+// initSessionStore returns the store to fetch rails sessions from
+// when they are kept in memcache or redis
+func initSessionStore(c *Config) (sessionStore, error) {
+	ru := c.Auth.Rails.URL
 
-	switch at {
-	case "rails":
-		if strings.HasPrefix(ru, "memcache:") {
-			return railsMemcacheHandler(next)
-		}
+	if c.Auth.Type != "rails" ||
+		!(strings.HasPrefix(ru, "memcache:") || strings.HasPrefix(ru, "redis")) {
+		return nil, nil
+	}
+
+	return newSessionStore(c)
+}
 
-		if strings.HasPrefix(ru, "redis:") {
-			return railsRedisHandler(next)
+// withAuth returns next wrapped with the configured authentication, an
+// error is returned when the auth config is not valid
+func withAuth(conf *Config, store sessionStore, log *zerolog.Logger,
+	next http.HandlerFunc) (http.HandlerFunc, error) {
+	switch conf.Auth.Type {
+	case "rails":
+		if store != nil {
+			return railsStoreHandler(conf, store, log, next)
 		}
 
-		return railsCookieHandler(next)
+		return railsCookieHandler(conf, log, next)
 
 	case "jwt":
-		return jwtHandler(next)
+		return jwtHandler(conf, next)
 	}
 
-	return next
+	return next, nil
 }
@@ -15,7 +15,7 @@ const (
 	jwtAuth0
 )
 
-func jwtHandler(next http.HandlerFunc) http.HandlerFunc {
+func jwtHandler(conf *Config, next http.HandlerFunc) (http.HandlerFunc, error) {
 	var key interface{}
 	var jwtProvider int
 
@@ -35,7 +35,7 @@ func jwtHandler(next http.HandlerFunc) http.HandlerFunc {
 	case len(publicKeyFile) != 0:
 		kd, err := ioutil.ReadFile(publicKeyFile)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
 		switch conf.Auth.JWT.PubKeyType {
@@ -51,7 +51,7 @@ func jwtHandler(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 	}
 
@@ -104,5 +104,5 @@ func jwtHandler(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		next.ServeHTTP(w, r)
-	}
+	}, nil
 }
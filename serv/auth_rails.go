@@ -5,41 +5,21 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"net/url"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/dosco/super-graph/rails"
 	"github.com/garyburd/redigo/redis"
+	"github.com/rs/zerolog"
 )
 
-func railsRedisHandler(next http.HandlerFunc) http.HandlerFunc {
+func railsStoreHandler(conf *Config, store sessionStore, log *zerolog.Logger,
+	next http.HandlerFunc) (http.HandlerFunc, error) {
 	cookie := conf.Auth.Cookie
 	if len(cookie) == 0 {
-		logger.Fatal().Msg("no auth.cookie defined")
+		return nil, errors.New("no auth.cookie defined")
 	}
 
-	if len(conf.Auth.Rails.URL) == 0 {
-		logger.Fatal().Msg("no auth.rails.url defined")
-	}
-
-	rp := &redis.Pool{
-		MaxIdle:   conf.Auth.Rails.MaxIdle,
-		MaxActive: conf.Auth.Rails.MaxActive,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.DialURL(conf.Auth.Rails.URL)
-			if err != nil {
-				panic(err)
-			}
-
-			pwd := conf.Auth.Rails.Password
-			if len(pwd) != 0 {
-				if _, err := c.Do("AUTH", pwd); err != nil {
-					panic(err)
-				}
-			}
-			return c, err
-		},
-	}
+	sc := newSessionCache(conf.Auth.Rails.SessionCacheTTL)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		if rn := headerAuth(r, conf); rn != nil {
@@ -53,80 +33,53 @@ func railsRedisHandler(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		key := fmt.Sprintf("session:%s", ck.Value)
-		sessionData, err := redis.Bytes(rp.Get().Do("GET", key))
-		if err != nil {
-			next.ServeHTTP(w, r)
-			return
-		}
-
-		userID, err := rails.ParseCookie(string(sessionData))
-		if err != nil {
-			next.ServeHTTP(w, r)
-			return
-		}
+		userID, ok := sc.get(ck.Value)
 
-		ctx := context.WithValue(r.Context(), userIDKey, userID)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	}
-}
+		if !ok {
+			key := fmt.Sprintf("session:%s", ck.Value)
 
-func railsMemcacheHandler(next http.HandlerFunc) http.HandlerFunc {
-	cookie := conf.Auth.Cookie
-	if len(cookie) == 0 {
-		logger.Fatal().Msg("no auth.cookie defined")
-	}
+			sessionData, err := store.get(key)
 
-	if len(conf.Auth.Rails.URL) == 0 {
-		logger.Fatal().Msg("no auth.rails.url defined")
-	}
+			switch {
+			case err == redis.ErrNil || err == memcache.ErrCacheMiss:
+				next.ServeHTTP(w, r)
+				return
 
-	rURL, err := url.Parse(conf.Auth.Rails.URL)
-	if err != nil {
-		logger.Fatal().Err(err)
-	}
+			case err != nil:
+				log.Warn().Err(err).Msg("failed to fetch rails session")
 
-	mc := memcache.New(rURL.Host)
-
-	return func(w http.ResponseWriter, r *http.Request) {
-		if rn := headerAuth(r, conf); rn != nil {
-			next.ServeHTTP(w, rn)
-			return
-		}
-
-		ck, err := r.Cookie(cookie)
-		if err != nil {
-			next.ServeHTTP(w, r)
-			return
-		}
+				// the session cached before the store failed is used
+				if userID, ok = sc.stale(ck.Value); !ok {
+					next.ServeHTTP(w, r)
+					return
+				}
 
-		key := fmt.Sprintf("session:%s", ck.Value)
-		item, err := mc.Get(key)
-		if err != nil {
-			next.ServeHTTP(w, r)
-			return
-		}
+			default:
+				userID, err = rails.ParseCookie(string(sessionData))
+				if err != nil {
+					next.ServeHTTP(w, r)
+					return
+				}
 
-		userID, err := rails.ParseCookie(string(item.Value))
-		if err != nil {
-			next.ServeHTTP(w, r)
-			return
+				sc.set(ck.Value, userID)
+			}
 		}
 
 		ctx := context.WithValue(r.Context(), userIDKey, userID)
 		next.ServeHTTP(w, r.WithContext(ctx))
-	}
+	}, nil
 }
 
-func railsCookieHandler(next http.HandlerFunc) http.HandlerFunc {
+func railsCookieHandler(conf *Config, log *zerolog.Logger,
+	next http.HandlerFunc) (http.HandlerFunc, error) {
 	cookie := conf.Auth.Cookie
 	if len(cookie) == 0 {
-		logger.Fatal().Msg("no auth.cookie defined")
+		return nil, errors.New("no auth.cookie defined")
 	}
 
 	ra, err := railsAuth(conf)
 	if err != nil {
-		logger.Fatal().Err(err)
+		return nil, err
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -137,24 +90,24 @@ func railsCookieHandler(next http.HandlerFunc) http.HandlerFunc {
 
 		ck, err := r.Cookie(cookie)
 		if err != nil {
-			logger.Error().Err(err)
+			log.Error().Err(err)
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		userID, err := ra.ParseCookie(ck.Value)
 		if err != nil {
-			logger.Error().Err(err)
+			log.Error().Err(err)
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), userIDKey, userID)
 		next.ServeHTTP(w, r.WithContext(ctx))
-	}
+	}, nil
 }
 
-func railsAuth(c *config) (*rails.Auth, error) {
+func railsAuth(c *Config) (*rails.Auth, error) {
 	secret := c.Auth.Rails.SecretKeyBase
 	if len(secret) == 0 {
 		return nil, errors.New("no auth.rails.secret_key_base defined")
@@ -174,11 +127,11 @@ func railsAuth(c *config) (*rails.Auth, error) {
 		ra.Salt = c.Auth.Rails.Salt
 	}
 
-	if len(conf.Auth.Rails.SignSalt) != 0 {
+	if len(c.Auth.Rails.SignSalt) != 0 {
 		ra.SignSalt = c.Auth.Rails.SignSalt
 	}
 
-	if len(conf.Auth.Rails.AuthSalt) != 0 {
+	if len(c.Auth.Rails.AuthSalt) != 0 {
 		ra.AuthSalt = c.Auth.Rails.AuthSalt
 	}
 
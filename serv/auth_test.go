@@ -0,0 +1,36 @@
+package serv
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestWithAuthConfigErrors(t *testing.T) {
+	next := func(w http.ResponseWriter, r *http.Request) {}
+
+	c := &Config{}
+	c.Auth.Type = "rails"
+
+	if _, err := withAuth(c, nil, testLog(), next); err == nil {
+		t.Error("expecting an error for rails auth without a cookie")
+	}
+
+	c.Auth.Cookie = "_app_session"
+
+	if _, err := withAuth(c, nil, testLog(), next); err == nil {
+		t.Error("expecting an error for rails auth without a secret_key_base")
+	}
+
+	c.Auth.Type = "jwt"
+	c.Auth.JWT.PubKeyFile = "./testdata/missing.pem"
+
+	if _, err := withAuth(c, nil, testLog(), next); err == nil {
+		t.Error("expecting an error for a missing jwt public key")
+	}
+
+	c.Auth.JWT.PubKeyFile, c.Auth.JWT.Secret = "", "secret"
+
+	if h, err := withAuth(c, nil, testLog(), next); err != nil || h == nil {
+		t.Errorf("expecting a jwt handler got %v", err)
+	}
+}
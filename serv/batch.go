@@ -0,0 +1,162 @@
+package serv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/dosco/super-graph/jsn"
+)
+
+const (
+	defaultBatchSize        = 100
+	defaultBatchConcurrency = 4
+)
+
+// batchFn fetches the remote data for several ids in a single
+// request, the response is split back into the data for each id
+type batchFn struct {
+	Size        int
+	Concurrency int
+	Fn          func(rr *remoteReq, ids [][]byte) (map[string][]byte, error)
+}
+
+func buildBatchFn(r ConfigRemote, rc *remoteClient) (*batchFn, error) {
+	method := strings.ToUpper(r.BatchMethod)
+
+	switch method {
+	case "", "GET":
+		method = "GET"
+		if !strings.Contains(r.BatchURL, "$ids") {
+			return nil, fmt.Errorf("remote %s: batch_url needs an $ids variable", r.Name)
+		}
+	case "POST":
+	default:
+		return nil, fmt.Errorf("remote %s: unsupported batch_method %s", r.Name, r.BatchMethod)
+	}
+
+	var path [][]byte
+	if len(r.Path) != 0 {
+		for _, p := range strings.Split(r.Path, ".") {
+			path = append(path, []byte(p))
+		}
+	}
+
+	var key []string
+	if len(r.BatchKey) != 0 {
+		key = strings.Split(r.BatchKey, ".")
+	}
+
+	fn := func(rr *remoteReq, ids [][]byte) (map[string][]byte, error) {
+		var b []byte
+		var err error
+
+		v := make([]string, len(ids))
+
+		if method == "GET" {
+			for i := range ids {
+				v[i] = url.QueryEscape(string(ids[i]))
+			}
+			uri := strings.Replace(r.BatchURL, "$ids", strings.Join(v, ","), 1)
+			b, err = rc.do(rr, "GET", uri, nil)
+
+		} else {
+			for i := range ids {
+				v[i] = string(ids[i])
+			}
+			var body []byte
+
+			if body, err = json.Marshal(map[string][]string{"ids": v}); err != nil {
+				return nil, err
+			}
+			b, err = rc.do(rr, "POST", r.BatchURL, body)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(path) != 0 {
+			b = jsn.Strip(b, path)
+		}
+
+		return splitBatch(b, key)
+	}
+
+	bf := &batchFn{
+		Size:        r.BatchSize,
+		Concurrency: r.BatchConcurrency,
+		Fn:          fn,
+	}
+
+	if bf.Size <= 0 {
+		bf.Size = defaultBatchSize
+	}
+
+	if bf.Concurrency <= 0 {
+		bf.Concurrency = defaultBatchConcurrency
+	}
+
+	return bf, nil
+}
+
+// splitBatch splits a batch response into the data for each id. The
+// response is either an object keyed by id or a list of objects with
+// the id found using the key path.
+func splitBatch(b []byte, key []string) (map[string][]byte, error) {
+	b = bytes.TrimSpace(b)
+
+	if len(b) != 0 && b[0] == '{' && len(key) == 0 {
+		var m map[string]json.RawMessage
+
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, err
+		}
+
+		res := make(map[string][]byte, len(m))
+		for k, v := range m {
+			res[k] = v
+		}
+		return res, nil
+	}
+
+	if len(key) == 0 {
+		return nil, fmt.Errorf("batch_key is needed to split a list response")
+	}
+
+	var list []json.RawMessage
+
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+
+	res := make(map[string][]byte, len(list))
+
+	for _, item := range list {
+		v := item
+
+		for _, k := range key {
+			var m map[string]json.RawMessage
+
+			if err := json.Unmarshal(v, &m); err != nil {
+				return nil, err
+			}
+
+			if v = m[k]; v == nil {
+				break
+			}
+		}
+
+		if len(v) == 0 {
+			continue
+		}
+
+		if id := jsn.Value(v); id != nil {
+			res[string(id)] = item
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,130 @@
+package serv
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dosco/super-graph/jsn"
+)
+
+func TestSplitBatch(t *testing.T) {
+	list := []byte(`[
+		{ "customer": { "id": "cus_1" }, "amount": 10 },
+		{ "customer": { "id": "cus_2" }, "amount": 20 }
+	]`)
+
+	m, err := splitBatch(list, []string{"customer", "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m) != 2 || !strings.Contains(string(m["cus_2"]), `"amount": 20`) {
+		t.Errorf("unexpected split %q", m)
+	}
+
+	obj := []byte(`{ "1": { "amount": 10 }, "2": [{ "amount": 20 }] }`)
+
+	m, err = splitBatch(obj, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(m["1"]) != `{ "amount": 10 }` || string(m["2"]) != `[{ "amount": 20 }]` {
+		t.Errorf("unexpected split %q", m)
+	}
+
+	if _, err := splitBatch(list, nil); err == nil {
+		t.Error("expecting an error for a list without a batch_key")
+	}
+}
+
+func TestBatchFn(t *testing.T) {
+	var calls int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		var ids []string
+
+		if r.Method == "POST" {
+			var body struct{ IDs []string }
+			json.NewDecoder(r.Body).Decode(&body)
+			ids = body.IDs
+		} else {
+			ids = strings.Split(r.URL.Query().Get("ids"), ",")
+		}
+
+		var data []map[string]interface{}
+		for _, id := range ids {
+			data = append(data, map[string]interface{}{"id": id, "amount": 10})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	defer ts.Close()
+
+	for _, method := range []string{"get", "post"} {
+		calls = 0
+
+		c, sel, rsmap := remoteTestContext(false)
+		rf := c.rmap[mkkey(xxhash.New(), "payments", "users")]
+
+		conf := ConfigRemote{
+			Name:        "payments",
+			Path:        "data",
+			BatchURL:    ts.URL + "/payments?ids=$ids",
+			BatchMethod: method,
+			BatchKey:    "id",
+			BatchSize:   2,
+		}
+
+		bf, err := buildBatchFn(conf, newRemoteClient(conf, testLog()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rf.Batch = bf
+
+		data := []byte(`[{"__users_id_1": 1}, {"__users_id_1": 2}, {"__users_id_1": 3}, {"__users_id_1": 1}]`)
+		from := jsn.Get(data, [][]byte{[]byte("__users_id_1")})
+
+		to, err := c.resolveRemotes(nil, from, sel, rsmap)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ob bytes.Buffer
+
+		if err := jsn.Replace(&ob, data, from, to); err != nil {
+			t.Fatal(err)
+		}
+
+		exp := `[{"payments":{"amount":10}}, {"payments":{"amount":10}}, {"payments":{"amount":10}}, {"payments":{"amount":10}}]`
+		if ob.String() != exp {
+			t.Errorf("%s: expecting %s got %s", method, exp, ob.String())
+		}
+
+		// 3 unique ids with a batch size of 2
+		if calls != 2 {
+			t.Errorf("%s: expecting 2 requests got %d", method, calls)
+		}
+	}
+}
+
+func TestBatchFnConfig(t *testing.T) {
+	conf := ConfigRemote{BatchURL: "http://payments/batch"}
+
+	if _, err := buildBatchFn(conf, newRemoteClient(conf, testLog())); err == nil {
+		t.Error("expecting an error for a batch_url without $ids")
+	}
+
+	conf.BatchMethod = "put"
+
+	if _, err := buildBatchFn(conf, newRemoteClient(conf, testLog())); err == nil {
+		t.Error("expecting an error for an unsupported batch_method")
+	}
+}
@@ -0,0 +1,344 @@
+package serv
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dosco/super-graph/qcode"
+	"github.com/garyburd/redigo/redis"
+	"github.com/go-pg/pg"
+	"github.com/gobuffalo/flect"
+	"github.com/rs/zerolog"
+)
+
+// cacheStore is implemented by the response cache backends. Cached
+// values are tagged with the database tables they were built from
+// so they can be invalidated when those tables change.
+type cacheStore interface {
+	get(key string) ([]byte, bool)
+	set(key string, val []byte, tables []string, ttl time.Duration)
+	invalidate(table string)
+}
+
+type responseCache struct {
+	store cacheStore
+	ttl   time.Duration
+	tmap  map[string]time.Duration
+
+	// query hash to cachedQuery
+	queries sync.Map
+}
+
+type cachedQuery struct {
+	// set when the response depends on the authenticated user
+	userScoped bool
+	qcost      *queryCost
+}
+
+func initCache(c *Config, db *pg.DB, log *zerolog.Logger) (*responseCache, error) {
+	if !c.Cache.Enable {
+		return nil, nil
+	}
+
+	rc := &responseCache{
+		ttl:  c.Cache.TTL,
+		tmap: make(map[string]time.Duration),
+	}
+
+	maxTTL := rc.ttl
+
+	for _, t := range c.DB.Tables {
+		if t.CacheTTL == 0 {
+			continue
+		}
+		rc.tmap[flect.Singularize(t.Name)] = t.CacheTTL
+		rc.tmap[flect.Pluralize(t.Name)] = t.CacheTTL
+
+		if t.CacheTTL > maxTTL {
+			maxTTL = t.CacheTTL
+		}
+	}
+
+	if len(c.Cache.URL) != 0 {
+		rc.store = newRedisCache(c.Cache.URL, maxTTL, log)
+	} else {
+		rc.store = newLRUCache(c.Cache.Size)
+	}
+
+	if len(c.Cache.Channel) != 0 {
+		ln := db.Listen(c.Cache.Channel)
+
+		go func() {
+			for n := range ln.Channel() {
+				log.Debug().Msgf("cache invalidated: %s", n.Payload)
+				rc.store.invalidate(strings.ToLower(n.Payload))
+			}
+		}()
+	}
+
+	return rc, nil
+}
+
+func (rc *responseCache) get(c *coreContext) ([]byte, *queryCost, bool) {
+	qh := gqlHash([]byte(c.req.Query))
+
+	v, ok := rc.queries.Load(qh)
+	if !ok {
+		return nil, nil, false
+	}
+	cq := v.(*cachedQuery)
+
+	data, ok := rc.store.get(rc.key(c, qh, cq.userScoped))
+	return data, cq.qcost, ok
+}
+
+func (rc *responseCache) set(c *coreContext, qc *qcode.QCode, qcost *queryCost,
+	scoped bool, data []byte) {
+	var ttl time.Duration
+	tables := make([]string, 0, len(qc.Query.Selects))
+
+	// the shortest ttl of all the tables in the query is used and
+	// a negative ttl on any table disables caching
+	for i := range qc.Query.Selects {
+		s := &qc.Query.Selects[i]
+
+		t := rc.ttl
+		if v, ok := rc.tmap[s.Table]; ok {
+			t = v
+		}
+
+		if i == 0 || t < ttl {
+			ttl = t
+		}
+
+		// remote tables are not found in the database schema
+		if tn, err := c.pcompile.TableName(s.Table); err == nil {
+			tables = append(tables, tn)
+		}
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	qh := gqlHash([]byte(c.req.Query))
+	rc.queries.Store(qh, &cachedQuery{scoped, qcost})
+
+	rc.store.set(rc.key(c, qh, scoped), data, tables, ttl)
+}
+
+// reset forgets all cached queries, their cached responses are
+// no longer used and expire from the store
+func (rc *responseCache) reset() {
+	rc.queries.Range(func(k, v interface{}) bool {
+		rc.queries.Delete(k)
+		return true
+	})
+}
+
+func (rc *responseCache) key(c *coreContext, qh string, scoped bool) string {
+	h := sha1.New()
+	io.WriteString(h, qh)
+
+	// map keys are sorted when encoded
+	if len(c.req.Vars) != 0 {
+		json.NewEncoder(h).Encode(c.req.Vars)
+	}
+
+	if scoped {
+		if v := c.Value(userIDProviderKey); v != nil {
+			io.WriteString(h, v.(string))
+		}
+		io.WriteString(h, ":")
+		if v := c.Value(userIDKey); v != nil {
+			io.WriteString(h, v.(string))
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *coreContext) cacheable() bool {
+	return c.respCache != nil && len(strings.TrimSpace(c.req.Query)) != 0
+}
+
+// in-memory lru
+
+type lruCache struct {
+	sync.Mutex
+	size   int
+	ll     *list.List
+	items  map[string]*list.Element
+	tables map[string]map[string]struct{}
+}
+
+type lruItem struct {
+	key    string
+	val    []byte
+	tables []string
+	exp    time.Time
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:   size,
+		ll:     list.New(),
+		items:  make(map[string]*list.Element),
+		tables: make(map[string]map[string]struct{}),
+	}
+}
+
+func (lc *lruCache) get(key string) ([]byte, bool) {
+	lc.Lock()
+	defer lc.Unlock()
+
+	e, ok := lc.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := e.Value.(*lruItem)
+
+	if time.Now().After(item.exp) {
+		lc.remove(e)
+		return nil, false
+	}
+
+	lc.ll.MoveToFront(e)
+	return item.val, true
+}
+
+func (lc *lruCache) set(key string, val []byte, tables []string, ttl time.Duration) {
+	lc.Lock()
+	defer lc.Unlock()
+
+	if e, ok := lc.items[key]; ok {
+		lc.remove(e)
+	}
+
+	item := &lruItem{key, val, tables, time.Now().Add(ttl)}
+	lc.items[key] = lc.ll.PushFront(item)
+
+	for _, t := range tables {
+		if _, ok := lc.tables[t]; !ok {
+			lc.tables[t] = make(map[string]struct{})
+		}
+		lc.tables[t][key] = struct{}{}
+	}
+
+	for lc.size > 0 && lc.ll.Len() > lc.size {
+		lc.remove(lc.ll.Back())
+	}
+}
+
+func (lc *lruCache) invalidate(table string) {
+	lc.Lock()
+	defer lc.Unlock()
+
+	for k := range lc.tables[table] {
+		if e, ok := lc.items[k]; ok {
+			lc.remove(e)
+		}
+	}
+	delete(lc.tables, table)
+}
+
+func (lc *lruCache) remove(e *list.Element) {
+	item := e.Value.(*lruItem)
+
+	lc.ll.Remove(e)
+	delete(lc.items, item.key)
+
+	for _, t := range item.tables {
+		delete(lc.tables[t], item.key)
+	}
+}
+
+// redis, shared between super graph instances
+
+type redisCache struct {
+	rp *redis.Pool
+
+	// the sets of keys for each table expire after the longest ttl
+	// so they don't grow with keys that have already expired
+	maxTTL time.Duration
+	log    *zerolog.Logger
+}
+
+func newRedisCache(url string, maxTTL time.Duration, log *zerolog.Logger) *redisCache {
+	rp := &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 4 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(url,
+				redis.DialConnectTimeout(time.Second),
+				redis.DialReadTimeout(500*time.Millisecond),
+				redis.DialWriteTimeout(500*time.Millisecond))
+		},
+	}
+
+	return &redisCache{rp, maxTTL, log}
+}
+
+func (rc *redisCache) get(key string) ([]byte, bool) {
+	conn := rc.rp.Get()
+	defer conn.Close()
+
+	b, err := redis.Bytes(conn.Do("GET", "sg:resp:"+key))
+	if err != nil {
+		if err != redis.ErrNil {
+			rc.log.Warn().Err(err).Msg("cache get failed")
+		}
+		return nil, false
+	}
+
+	return b, true
+}
+
+func (rc *redisCache) set(key string, val []byte, tables []string, ttl time.Duration) {
+	conn := rc.rp.Get()
+	defer conn.Close()
+
+	key = "sg:resp:" + key
+
+	conn.Send("MULTI")
+	conn.Send("SET", key, val, "PX", int64(ttl/time.Millisecond))
+
+	for _, t := range tables {
+		conn.Send("SADD", "sg:table:"+t, key)
+		conn.Send("PEXPIRE", "sg:table:"+t, int64(rc.maxTTL/time.Millisecond))
+	}
+
+	if _, err := conn.Do("EXEC"); err != nil {
+		rc.log.Warn().Err(err).Msg("cache set failed")
+	}
+}
+
+func (rc *redisCache) invalidate(table string) {
+	conn := rc.rp.Get()
+	defer conn.Close()
+
+	tk := "sg:table:" + table
+
+	keys, err := redis.Strings(conn.Do("SMEMBERS", tk))
+	if err != nil {
+		rc.log.Warn().Err(err).Msg("cache invalidate failed")
+		return
+	}
+
+	args := make([]interface{}, 0, len(keys)+1)
+	args = append(args, tk)
+
+	for i := range keys {
+		args = append(args, keys[i])
+	}
+
+	if _, err := conn.Do("DEL", args...); err != nil {
+		rc.log.Warn().Err(err).Msg("cache invalidate failed")
+	}
+}
@@ -0,0 +1,148 @@
+package serv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEviction(t *testing.T) {
+	lc := newLRUCache(2)
+
+	lc.set("a", []byte("1"), nil, time.Minute)
+	lc.set("b", []byte("2"), nil, time.Minute)
+
+	// touch 'a' so 'b' is the least recently used
+	lc.get("a")
+	lc.set("c", []byte("3"), nil, time.Minute)
+
+	if _, ok := lc.get("b"); ok {
+		t.Fatal("Expecting 'b' to be evicted")
+	}
+
+	if v, ok := lc.get("a"); !ok || string(v) != "1" {
+		t.Fatal("Expecting 'a' to be cached")
+	}
+}
+
+func TestLRUCacheInvalidate(t *testing.T) {
+	lc := newLRUCache(10)
+
+	lc.set("a", []byte("1"), []string{"products"}, time.Minute)
+	lc.set("b", []byte("2"), []string{"products", "users"}, time.Minute)
+	lc.set("c", []byte("3"), []string{"users"}, time.Minute)
+
+	lc.invalidate("products")
+
+	if _, ok := lc.get("a"); ok {
+		t.Fatal("Expecting 'a' to be invalidated")
+	}
+
+	if _, ok := lc.get("b"); ok {
+		t.Fatal("Expecting 'b' to be invalidated")
+	}
+
+	if _, ok := lc.get("c"); !ok {
+		t.Fatal("Expecting 'c' to be cached")
+	}
+}
+
+func TestLRUCacheExpiry(t *testing.T) {
+	lc := newLRUCache(10)
+	lc.set("a", []byte("1"), nil, 10*time.Millisecond)
+
+	time.Sleep(20 * time.Millisecond)
+
+	if _, ok := lc.get("a"); ok {
+		t.Fatal("Expecting 'a' to have expired")
+	}
+}
+
+// fakeRedis answers each command with the reply from fn, the reply
+// is written as is so it has to be in the redis protocol
+func fakeRedis(t *testing.T, fn func(args []string) string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(cn net.Conn) {
+		defer cn.Close()
+		rd := bufio.NewReader(cn)
+
+		for {
+			var n int
+			if _, err := fmt.Fscanf(rd, "*%d\r\n", &n); err != nil {
+				return
+			}
+
+			args := make([]string, n)
+
+			for i := range args {
+				var l int
+				if _, err := fmt.Fscanf(rd, "$%d\r\n", &l); err != nil {
+					return
+				}
+				b := make([]byte, l+2)
+				if _, err := io.ReadFull(rd, b); err != nil {
+					return
+				}
+				args[i] = string(b[:l])
+			}
+
+			cn.Write([]byte(fn(args)))
+		}
+	}
+
+	go func() {
+		for {
+			cn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(cn)
+		}
+	}()
+
+	return ln
+}
+
+func TestRedisCacheTableExpiry(t *testing.T) {
+	var mu sync.Mutex
+	var cmds []string
+
+	ln := fakeRedis(t, func(args []string) string {
+		mu.Lock()
+		cmds = append(cmds, strings.Join(args, " "))
+		mu.Unlock()
+
+		switch args[0] {
+		case "MULTI":
+			return "+OK\r\n"
+		case "EXEC":
+			return "*0\r\n"
+		}
+		return "+QUEUED\r\n"
+	})
+	defer ln.Close()
+
+	rc := newRedisCache("redis://"+ln.Addr().String(), time.Hour, testLog())
+	rc.set("a", []byte("1"), []string{"products"}, time.Minute)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	exp := "PEXPIRE sg:table:products 3600000"
+
+	for _, v := range cmds {
+		if v == exp {
+			return
+		}
+	}
+	t.Errorf("expecting '%s' got %v", exp, cmds)
+}
@@ -0,0 +1,160 @@
+package serv
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const allowUsage = `Usage: super-graph [-path <folder>] allow <command> [args]
+
+Commands:
+  list                 list the queries in the allow list
+  validate             compile and prepare every query against the database
+  remove <hash|name>   remove queries by hash, hash prefix or operation name
+  merge <file>...      merge other allow lists into this one
+`
+
+// cmdAllow runs the allow list management commands and returns
+// the exit code
+func cmdAllow(path string, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, allowUsage)
+		return 2
+	}
+
+	fp, err := findAllowList(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	al := &allowList{list: make(map[string]*allowItem)}
+
+	if _, err := al.read(fp); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "list":
+		al.print(os.Stdout)
+		return 0
+
+	case "validate":
+		return cmdAllowValidate(path, al)
+
+	case "remove":
+		if len(args) < 2 {
+			fmt.Fprint(os.Stderr, allowUsage)
+			return 2
+		}
+
+		n := 0
+		for _, k := range args[1:] {
+			n += al.remove(k)
+		}
+		return writeAllowList(al, fmt.Sprintf("removed %d queries", n))
+
+	case "merge":
+		if len(args) < 2 {
+			fmt.Fprint(os.Stderr, allowUsage)
+			return 2
+		}
+
+		n := 0
+		for _, f := range args[1:] {
+			other := &allowList{list: make(map[string]*allowItem)}
+
+			if _, err := other.read(f); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			n += al.merge(other)
+		}
+		return writeAllowList(al, fmt.Sprintf("added %d queries", n))
+	}
+
+	fmt.Fprint(os.Stderr, allowUsage)
+	return 2
+}
+
+func cmdAllowValidate(path string, al *allowList) int {
+	conf, err := initConf(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to read config:", err)
+		return 1
+	}
+
+	db, err := initDB(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to connect to database:", err)
+		return 1
+	}
+	defer db.Close()
+
+	qcompile, pcompile, err := initCompilers(conf, db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to load database schema:", err)
+		return 1
+	}
+
+	// remote joins are registered as relationships in the compiler
+	if _, err := initResolvers(conf, pcompile, logger); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to initialize resolvers:", err)
+		return 1
+	}
+
+	failed := 0
+
+	for _, v := range al.sorted() {
+		ps, err := prepareStmt(v, qcompile, pcompile)
+
+		// the database checks the sql when it's prepared
+		if err == nil && ps != nil {
+			_, err = ps.primaryStmt(db)
+			ps.close()
+		}
+
+		if err != nil {
+			fmt.Printf("FAIL %s %s: %s\n", v.Hash, v.Name, err)
+			failed++
+		}
+	}
+
+	fmt.Printf("%d queries, %d failed\n", len(al.list), failed)
+
+	if failed != 0 {
+		return 1
+	}
+	return 0
+}
+
+func writeAllowList(al *allowList, msg string) int {
+	if err := al.write(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("%s, saved to %s\n", msg, al.filepath)
+	return 0
+}
+
+func (al *allowList) print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HASH\tNAME\tROLE\tVARS\tFIRST SEEN\tREFERER")
+
+	for _, v := range al.sorted() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			v.Hash[:minHashPrefix],
+			v.Name,
+			v.Role,
+			strings.Join(v.Vars, ","),
+			v.FirstSeen.Format("2006-01-02"),
+			v.URI)
+	}
+
+	tw.Flush()
+}
@@ -2,11 +2,14 @@ package serv
 
 import (
 	"strings"
+	"time"
 
 	"github.com/gobuffalo/flect"
 )
 
-type config struct {
+// Config is the super graph config, usually read from a config
+// file using ReadInConfig
+type Config struct {
 	AppName       string `mapstructure:"app_name"`
 	Env           string
 	HostPort      string `mapstructure:"host_port"`
@@ -14,7 +17,10 @@ type config struct {
 	Port          string
 	WebUI         bool   `mapstructure:"web_ui"`
 	LogLevel      string `mapstructure:"log_level"`
+	LogFormat     string `mapstructure:"log_format"`
 	EnableTracing bool   `mapstructure:"enable_tracing"`
+	EnableMetrics bool   `mapstructure:"enable_metrics"`
+	EnableExplain bool   `mapstructure:"enable_explain"`
 	UseAllowList  bool   `mapstructure:"use_allow_list"`
 	AuthFailBlock string `mapstructure:"auth_fail_block"`
 	Inflections   map[string]string
@@ -34,6 +40,12 @@ type config struct {
 			Salt          string
 			SignSalt      string `mapstructure:"sign_salt"`
 			AuthSalt      string `mapstructure:"auth_salt"`
+
+			ConnectTimeout  time.Duration `mapstructure:"connect_timeout"`
+			ReadTimeout     time.Duration `mapstructure:"read_timeout"`
+			WriteTimeout    time.Duration `mapstructure:"write_timeout"`
+			IdleTimeout     time.Duration `mapstructure:"idle_timeout"`
+			SessionCacheTTL time.Duration `mapstructure:"session_cache_ttl"`
 		}
 
 		JWT struct {
@@ -44,6 +56,38 @@ type config struct {
 		}
 	}
 
+	RateLimit struct {
+		Enable         bool
+		IPHeader       string `mapstructure:"ip_header"`
+		TrustedProxies int    `mapstructure:"trusted_proxies"`
+		CostUnit       int    `mapstructure:"cost_unit"`
+		Roles          map[string]ConfigRateLimit
+	} `mapstructure:"rate_limit"`
+
+	Limits struct {
+		MaxDepth   int `mapstructure:"max_depth"`
+		MaxSelects int `mapstructure:"max_selects"`
+		MaxCost    int `mapstructure:"max_cost"`
+	}
+
+	Admin struct {
+		Secret string
+	}
+
+	Telemetry struct {
+		Exporter    string
+		Endpoint    string
+		ServiceName string `mapstructure:"service_name"`
+	}
+
+	Cache struct {
+		Enable  bool
+		URL     string
+		Size    int
+		TTL     time.Duration
+		Channel string
+	}
+
 	DB struct {
 		Type       string
 		Host       string
@@ -56,6 +100,18 @@ type config struct {
 		MaxRetries int    `mapstructure:"max_retries"`
 		LogLevel   string `mapstructure:"log_level"`
 
+		Replicas             []ConfigReplica
+		ReplicaPolicy        string        `mapstructure:"replica_policy"`
+		ReplicaMaxLag        time.Duration `mapstructure:"replica_max_lag"`
+		ReplicaCheckInterval time.Duration `mapstructure:"replica_check_interval"`
+
+		SlowQuery struct {
+			Threshold     time.Duration
+			Explain       bool
+			ExplainSample float64 `mapstructure:"explain_sample"`
+			MaxPlans      int     `mapstructure:"max_plans"`
+		} `mapstructure:"slow_query"`
+
 		vars map[string][]byte `mapstructure:"variables"`
 
 		Defaults struct {
@@ -63,33 +119,97 @@ type config struct {
 			Blacklist []string
 		}
 
-		Fields []configTable
-		Tables []configTable
+		Fields []ConfigTable
+		Tables []ConfigTable
 	} `mapstructure:"database"`
+
+	// config file in use, watched for changes
+	file string
 }
 
-type configTable struct {
+// ConfigTable configures a database table
+type ConfigTable struct {
 	Name      string
 	Filter    []string
 	Table     string
 	Blacklist []string
-	Remotes   []configRemote
+	CacheTTL  time.Duration `mapstructure:"cache_ttl"`
+	Remotes   []ConfigRemote
+}
+
+// ConfigReplica is a read replica of the database, the user, password
+// and database name default to those of the primary
+type ConfigReplica struct {
+	Host     string
+	Port     string
+	DBName   string
+	User     string
+	Password string
+	PoolSize int `mapstructure:"pool_size"`
 }
 
-type configRemote struct {
+// ConfigRateLimit is the token bucket rate and burst for a role
+type ConfigRateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ConfigRemote configures a remote api joined with a table
+type ConfigRemote struct {
 	Name        string
 	ID          string
+	Columns     []string
+	Type        string
 	Path        string
+	Method      string
 	URL         string
+	Body        string
+	NullStatus  []int `mapstructure:"null_status"`
 	Debug       bool
+	Required    bool
 	PassHeaders []string `mapstructure:"pass_headers"`
 	SetHeaders  []struct {
 		Name  string
 		Value string
 	} `mapstructure:"set_headers"`
+
+	// fetch the data for all the ids in a single request
+	BatchURL         string `mapstructure:"batch_url"`
+	BatchMethod      string `mapstructure:"batch_method"`
+	BatchKey         string `mapstructure:"batch_key"`
+	BatchSize        int    `mapstructure:"batch_size"`
+	BatchConcurrency int    `mapstructure:"batch_concurrency"`
+
+	// the root field and id argument on a graphql remote
+	Field  string
+	IDArg  string `mapstructure:"id_arg"`
+	IDType string `mapstructure:"id_type"`
+
+	Timeout          time.Duration
+	Retries          int
+	RetryBackoff     time.Duration `mapstructure:"retry_backoff"`
+	BreakerThreshold int           `mapstructure:"breaker_threshold"`
+	BreakerTimeout   time.Duration `mapstructure:"breaker_timeout"`
+	CacheTTL         time.Duration `mapstructure:"cache_ttl"`
+}
+
+// init applies the inflections and table name defaults
+func (c *Config) init() {
+	for k, v := range c.Inflections {
+		flect.AddPlural(k, v)
+	}
+
+	if len(c.DB.Tables) == 0 {
+		c.DB.Tables = c.DB.Fields
+	}
+
+	for i := range c.DB.Tables {
+		t := c.DB.Tables[i]
+		t.Name = flect.Pluralize(strings.ToLower(t.Name))
+	}
 }
 
-func (c *config) getVariables() map[string]string {
+func (c *Config) getVariables() map[string]string {
 	vars := make(map[string]string, len(c.DB.vars))
 
 	for k, v := range c.DB.vars {
@@ -109,7 +229,7 @@ func (c *config) getVariables() map[string]string {
 	return vars
 }
 
-func (c *config) getAliasMap() map[string][]string {
+func (c *Config) getAliasMap() map[string][]string {
 	m := make(map[string][]string, len(c.DB.Tables))
 
 	for i := range c.DB.Tables {
@@ -125,7 +245,7 @@ func (c *config) getAliasMap() map[string][]string {
 	return m
 }
 
-func (c *config) getFilterMap() map[string][]string {
+func (c *Config) getFilterMap() map[string][]string {
 	m := make(map[string][]string, len(c.DB.Tables))
 
 	for i := range c.DB.Tables {
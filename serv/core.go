@@ -4,18 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/dosco/super-graph/jsn"
+	"github.com/dosco/super-graph/psql"
 	"github.com/dosco/super-graph/qcode"
 	"github.com/go-pg/pg"
+	"github.com/gobuffalo/flect"
 	"github.com/valyala/fasttemplate"
 )
 
@@ -26,309 +27,636 @@ const (
 type coreContext struct {
 	req gqlReq
 	res gqlResp
+
+	// set when the query depends on the authenticated user
+	userScoped bool
+
+	// logged with each log line for the request
+	reqID string
+
+	// guards res when remotes are fetched in parallel
+	resMu sync.Mutex
+
+	// paths in the response to the remote insertion points
+	rpaths *remotePaths
+
+	*SuperGraph
+	*snapshot
 	context.Context
 }
 
 func (c *coreContext) handleReq(w io.Writer, req *http.Request) error {
+	c.req.ref = req.Referer()
+	st := time.Now()
+
+	data, err := c.execQuery(req)
+	c.logRequest(st, len(data), err)
+
+	if err != nil {
+		return err
+	}
+
+	return c.render(w, data)
+}
+
+// execQuery runs the query and returns the response data, req is nil
+// when not called from an http request
+func (c *coreContext) execQuery(req *http.Request) ([]byte, error) {
 	var err error
-	var skipped uint32
+	var skip []psql.Skip
 	var qc *qcode.QCode
+	var ps *preparedItem
 	var data []byte
 
-	c.req.ref = req.Referer()
+	if c.conf.EnableTracing {
+		c.startTracing()
+		defer c.endTracing()
+	}
 
-	//conf.UseAllowList = true
+	// the role of allow list queries is checked before the cache
+	// is used since their cached responses are shared
+	if c.conf.UseAllowList {
+		if ps, err = c.allowedItem([]byte(c.req.Query)); err != nil {
+			return nil, err
+		}
+	}
+
+	useCache := c.cacheable()
+
+	if useCache {
+		if data, qcost, ok := c.respCache.get(c); ok {
+			c.addCost(qcost)
+			c.rateLimitCharge(qcost)
+			return data, nil
+		}
+	}
 
-	if conf.UseAllowList {
-		var ps *preparedItem
+	//conf.UseAllowList = true
 
-		data, ps, err = c.resolvePreparedSQL([]byte(c.req.Query))
+	if c.conf.UseAllowList {
+		data, err = c.resolvePreparedSQL(ps)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		skipped = ps.skipped
+		skip = ps.skip
 		qc = ps.qc
+		c.userScoped = ps.userScoped
 
 	} else {
 
-		qc, err = qcompile.CompileQuery([]byte(c.req.Query))
+		var op *qcode.Operation
+
+		_, sp := startSpan(c, "qcode.compile")
+		st := time.Now()
+
+		op, err = qcode.ParseQuery([]byte(c.req.Query))
+		c.tracePhase(phaseParsing, st)
+
+		if err == nil {
+			st = time.Now()
+			qc, err = c.qcompile.CompileOperation(op)
+			c.tracePhase(phaseValidation, st)
+		}
+
+		sp.setError(err)
+		sp.finish()
+
 		if err != nil {
-			return err
+			return nil, withCode(errCodeValidation, err)
 		}
 
-		data, skipped, err = c.resolveSQL(qc)
+		data, skip, err = c.resolveSQL(qc)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	if len(data) == 0 || skipped == 0 {
-		return c.render(w, data)
-	}
+	qcost := newQueryCost(qc, c.conf.Limits.MaxCost)
+	c.addCost(qcost)
+	c.rateLimitCharge(qcost)
 
 	sel := qc.Query.Selects
-	h := xxhash.New()
 
-	// fetch the field name used within the db response json
-	// that are used to mark insertion points and the mapping between
-	// those field names and their select objects
-	fids, sfmap := parentFieldIds(h, sel, skipped)
+	// fetch the keys used within the db response json to mark
+	// insertion points and the mapping between those keys and
+	// the remote selects
+	keys, rsmap := remoteSelects(sel, skip, c.rmap)
 
 	// fetch the field values of the marked insertion points
 	// these values contain the id to be used with fetching remote data
-	from := jsn.Get(data, fids)
+	var from []jsn.Field
+	if len(data) != 0 && len(keys) != 0 {
+		from = jsn.Get(data, keys)
+		c.rpaths = &remotePaths{data: data, keys: keys}
+	}
 
-	var to []jsn.Field
-	switch {
-	case len(from) == 1:
-		to, err = c.resolveRemote(req, h, from[0], sel, sfmap)
+	// no remote selects or only empty lists above them
+	if len(from) == 0 {
+		if useCache && len(data) != 0 {
+			c.respCache.set(c, qc, qcost, c.userScoped, data)
+		}
+		return data, nil
+	}
 
-	case len(from) > 1:
-		to, err = c.resolveRemotes(req, h, from, sel, sfmap)
+	var to []jsn.Field
 
-	default:
-		return errors.New("something wrong no remote ids found in db response")
+	if len(from) == 1 {
+		to, err = c.resolveRemote(req, from[0], sel, rsmap)
+	} else {
+		to, err = c.resolveRemotes(req, from, sel, rsmap)
 	}
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var ob bytes.Buffer
 
 	err = jsn.Replace(&ob, data, from, to)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return c.render(w, ob.Bytes())
+	// remote joins can pass on user headers so their responses
+	// are always cached per user, partial responses are not cached
+	if useCache && len(c.res.Errors) == 0 {
+		c.respCache.set(c, qc, qcost, true, ob.Bytes())
+	}
+
+	return ob.Bytes(), nil
 }
 
 func (c *coreContext) resolveRemote(
 	req *http.Request,
-	h *xxhash.Digest,
 	field jsn.Field,
 	sel []qcode.Select,
-	sfmap map[uint64]*qcode.Select) ([]jsn.Field, error) {
+	rsmap map[uint64]*remoteSel) ([]jsn.Field, error) {
 
 	// replacement data for the marked insertion points
 	// key and value will be replaced by whats below
 	toA := [1]jsn.Field{}
 	to := toA[:1]
 
-	// use the json key to find the related Select object
-	k1 := xxhash.Sum64(field.Key)
-
-	s, ok := sfmap[k1]
+	rs, ok := rsmap[xxhash.Sum64(field.Key)]
 	if !ok {
-		return nil, nil
+		to[0] = field
+		return to, nil
 	}
-	p := sel[s.ParentID]
+	s, r := rs.sel, rs.r
 
-	// then use the Table nme in the Select and it's parent
-	// to find the resolver to use for this relationship
-	k2 := mkkey(h, s.Table, p.Table)
-
-	r, ok := rmap[k2]
-	if !ok {
-		return nil, nil
+	if r.Batch != nil {
+		return c.resolveRemotes(req, []jsn.Field{field}, sel, rsmap)
 	}
 
-	id := jsn.Value(field.Value)
-	if len(id) == 0 {
-		return nil, nil
+	rr := c.newRemoteReq(req, r, field.Value)
+	if rr == nil {
+		to[0] = jsn.Field{Key: []byte(s.FieldName), Value: []byte("null")}
+		return to, nil
 	}
 
-	st := time.Now()
-
-	b, err := r.Fn(req, id)
+	b, err := c.fetchRemote(rr, sel, 0, rs)
 	if err != nil {
-		return nil, err
-	}
-
-	if conf.EnableTracing {
-		c.addTrace(sel, s.ID, st)
-	}
-
-	if len(r.Path) != 0 {
-		b = jsn.Strip(b, r.Path)
-	}
-
-	var ob bytes.Buffer
-
-	if len(s.Cols) != 0 {
-		err = jsn.Filter(&ob, b, colsToList(s.Cols))
-		if err != nil {
+		if r.Required {
 			return nil, err
 		}
-
-	} else {
-		ob.WriteString("null")
+		c.addRemoteError(0, rs, err)
+		b = []byte("null")
 	}
 
-	to[0] = jsn.Field{[]byte(s.FieldName), ob.Bytes()}
+	to[0] = jsn.Field{Key: []byte(s.FieldName), Value: b}
 	return to, nil
 }
 
 func (c *coreContext) resolveRemotes(
 	req *http.Request,
-	h *xxhash.Digest,
 	from []jsn.Field,
 	sel []qcode.Select,
-	sfmap map[uint64]*qcode.Select) ([]jsn.Field, error) {
+	rsmap map[uint64]*remoteSel) ([]jsn.Field, error) {
 
 	// replacement data for the marked insertion points
 	// key and value will be replaced by whats below
 	to := make([]jsn.Field, len(from))
 
-	var wg sync.WaitGroup
-	wg.Add(len(from))
-
-	var cerr error
+	// each goroutine only sets it's own error
+	errs := make([]error, len(from))
+	rsels := make([]*remoteSel, len(from))
+	rrs := make([]*remoteReq, len(from))
 
-	for i, id := range from {
+	// field indexes for each remote that fetches in batches
+	batches := make(map[*resolvFn][]int)
 
-		// use the json key to find the related Select object
-		k1 := xxhash.Sum64(id.Key)
+	var wg sync.WaitGroup
 
-		s, ok := sfmap[k1]
+	for i, field := range from {
+		rs, ok := rsmap[xxhash.Sum64(field.Key)]
 		if !ok {
-			return nil, nil
+			to[i] = field
+			continue
 		}
-		p := sel[s.ParentID]
-
-		// then use the Table nme in the Select and it's parent
-		// to find the resolver to use for this relationship
-		k2 := mkkey(h, s.Table, p.Table)
+		s, r := rs.sel, rs.r
+		rsels[i] = rs
 
-		r, ok := rmap[k2]
-		if !ok {
-			return nil, nil
+		rr := c.newRemoteReq(req, r, field.Value)
+		if rr == nil {
+			to[i] = jsn.Field{Key: []byte(s.FieldName), Value: []byte("null")}
+			continue
 		}
+		rrs[i] = rr
 
-		id := jsn.Value(id.Value)
-		if len(id) == 0 {
-			return nil, nil
+		if r.Batch != nil {
+			batches[r] = append(batches[r], i)
+			continue
 		}
 
-		go func(n int, id []byte, s *qcode.Select) {
-			defer wg.Done()
+		wg.Add(1)
 
-			st := time.Now()
+		go func(n int, rr *remoteReq, rs *remoteSel) {
+			defer wg.Done()
 
-			b, err := r.Fn(req, id)
+			b, err := c.fetchRemote(rr, sel, n, rs)
 			if err != nil {
-				cerr = fmt.Errorf("%s: %s", s.Table, err)
+				errs[n] = err
 				return
 			}
 
-			if conf.EnableTracing {
-				c.addTrace(sel, s.ID, st)
-			}
+			to[n] = jsn.Field{Key: []byte(rs.sel.FieldName), Value: b}
+		}(i, rr, rs)
+	}
 
-			if len(r.Path) != 0 {
-				b = jsn.Strip(b, r.Path)
-			}
+	for r, fi := range batches {
+		c.fetchBatches(&wg, req, sel, fi, rsels, rrs, r, to, errs)
+	}
+	wg.Wait()
 
-			var ob bytes.Buffer
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
 
-			if len(s.Cols) != 0 {
-				err = jsn.Filter(&ob, b, colsToList(s.Cols))
-				if err != nil {
-					cerr = fmt.Errorf("%s: %s", s.Table, err)
-					return
-				}
+		rs := rsels[i]
+
+		if rs.r.Required {
+			return nil, err
+		}
+
+		c.addRemoteError(i, rs, err)
+		to[i] = jsn.Field{Key: []byte(rs.sel.FieldName), Value: []byte("null")}
+	}
+
+	return to, nil
+}
+
+// fetchRemote calls the remote api for the n'th insertion point and
+// returns the selected fields from it's response
+func (c *coreContext) fetchRemote(
+	rr *remoteReq,
+	sel []qcode.Select,
+	n int,
+	rs *remoteSel) ([]byte, error) {
 
-			} else {
-				ob.WriteString("null")
+	s, r := rs.sel, rs.r
+	st := time.Now()
+
+	var b []byte
+	var err error
+
+	if r.GraphQL != nil {
+		b, err = r.GraphQL(rr, sel, s)
+	} else {
+		b, err = r.Fn(rr)
+	}
+	c.metrics.remote(r.Name, st, err)
+
+	if err != nil {
+		c.addRemoteTrace(sel, n, rs, st, []byte("null"))
+		return nil, withCode(errCodeRemote, fmt.Errorf("%s: %s", s.Table, err))
+	}
+
+	// graphql remotes only return the selected fields
+	if r.GraphQL != nil {
+		c.addRemoteTrace(sel, n, rs, st, b)
+		return b, nil
+	}
+
+	if len(r.Path) != 0 {
+		b = jsn.Strip(b, r.Path)
+	}
+	c.addRemoteTrace(sel, n, rs, st, b)
+
+	return filterRemote(s, b)
+}
+
+// fetchBatches fetches the remote data for the fields at the indexes
+// in fi using batch requests, at most Concurrency requests are run
+// at a time
+func (c *coreContext) fetchBatches(
+	wg *sync.WaitGroup,
+	req *http.Request,
+	sel []qcode.Select,
+	fi []int,
+	rsels []*remoteSel,
+	rrs []*remoteReq,
+	r *resolvFn,
+	to []jsn.Field,
+	errs []error) {
+
+	// the same id can be used by several fields
+	idx := make(map[string][]int, len(fi))
+	var ids [][]byte
+
+	for _, n := range fi {
+		id := rrs[n].id
+		k := string(id)
+
+		if _, ok := idx[k]; !ok {
+			ids = append(ids, id)
+		}
+		idx[k] = append(idx[k], n)
+	}
+
+	sem := make(chan struct{}, r.Batch.Concurrency)
+
+	for i := 0; i < len(ids); i += r.Batch.Size {
+		j := i + r.Batch.Size
+		if j > len(ids) {
+			j = len(ids)
+		}
+
+		wg.Add(1)
+
+		go func(ids [][]byte) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			st := time.Now()
+			res, err := r.Batch.Fn(&remoteReq{ctx: c.Context, inReq: req}, ids)
+			<-sem
+
+			c.metrics.remote(r.Name, st, err)
+
+			for _, id := range ids {
+				for _, n := range idx[string(id)] {
+					s := rsels[n].sel
+
+					if err != nil {
+						c.addRemoteTrace(sel, n, rsels[n], st, []byte("null"))
+						errs[n] = withCode(errCodeRemote, fmt.Errorf("%s: %s", s.Table, err))
+						continue
+					}
+
+					// ids missing in the response are set to null
+					b, ok := res[string(id)]
+					if !ok {
+						b = []byte("null")
+					}
+					c.addRemoteTrace(sel, n, rsels[n], st, b)
+
+					if b, errs[n] = filterRemote(s, b); errs[n] == nil {
+						to[n] = jsn.Field{Key: []byte(s.FieldName), Value: b}
+					}
+				}
 			}
+		}(ids[i:j])
+	}
+}
 
-			to[n] = jsn.Field{[]byte(s.FieldName), ob.Bytes()}
-		}(i, id, s)
+// filterRemote returns only the selected fields from the remote data
+func filterRemote(s *qcode.Select, b []byte) ([]byte, error) {
+	if len(s.Cols) == 0 || bytes.Equal(b, []byte("null")) {
+		return []byte("null"), nil
 	}
-	wg.Wait()
 
-	return to, cerr
+	var ob bytes.Buffer
+
+	err := jsn.Filter(&ob, b, colsToList(s.Cols))
+	if err != nil {
+		return nil, withCode(errCodeRemote, fmt.Errorf("%s: %s", s.Table, err))
+	}
+
+	return ob.Bytes(), nil
+}
+
+// addRemoteError adds an error for the remote field at the n'th
+// insertion point, the field is set to null and the rest of the
+// response is returned
+func (c *coreContext) addRemoteError(n int, rs *remoteSel, err error) {
+	c.log.Warn().Err(err).Str("request_id", c.reqID).Msg("remote join failed")
+
+	path := c.remotePath(n, rs)
+
+	c.resMu.Lock()
+	defer c.resMu.Unlock()
+
+	c.res.Errors = append(c.res.Errors, gqlError{
+		Message:    err.Error(),
+		Path:       path,
+		Extensions: &errExtensions{errCodeRemote},
+	})
 }
 
-func (c *coreContext) resolvePreparedSQL(gql []byte) ([]byte, *preparedItem, error) {
-	ps, ok := _preparedList[gqlHash(gql)]
+// remotePath returns the path in the response to the remote field at
+// the n'th insertion point, items of lists are in it by their index
+func (c *coreContext) remotePath(n int, rs *remoteSel) []interface{} {
+	p := c.rpaths.get(n)
+	if p == nil {
+		return rs.path
+	}
+
+	// the insertion point key is replaced by the remote field
+	path := make([]interface{}, len(p))
+	copy(path, p)
+	path[len(p)-1] = rs.sel.FieldName
+
+	return path
+}
+
+// allowedItem returns the prepared allow list query if the request
+// can run it
+func (c *coreContext) allowedItem(gql []byte) (*preparedItem, error) {
+	ps, ok := c.preparedList[gqlHash(gql)]
+	c.metrics.allowListLookup(ok)
+
 	if !ok {
-		return nil, nil, errUnauthorized
+		return nil, errNotAllowed
 	}
 
+	if err := c.checkAllowItem(ps.item); err != nil {
+		return nil, err
+	}
+
+	return ps, nil
+}
+
+func (c *coreContext) resolvePreparedSQL(ps *preparedItem) ([]byte, error) {
 	var root json.RawMessage
 	vars := varList(c, ps.args)
 
-	_, err := ps.stmt.QueryOne(pg.Scan(&root), vars...)
+	_, sp := startSpan(c, "db.query")
+	sp.setAttr("db.system", "postgresql")
+	sp.setAttr("db.prepared", "true")
+
+	var db *pg.DB
+	var stmt *pg.Stmt
+	var err error
+
+	r := c.readReplica()
+	defer r.done()
+
+	if r != nil {
+		if stmt, err = ps.replicaStmt(r); err == nil {
+			db = r.db
+			sp.setAttr("db.replica", r.name)
+		} else {
+			c.log.Warn().Err(err).Str("replica", r.name).Msg("failed to prepare statement on replica")
+		}
+	}
+
+	if stmt == nil {
+		db = c.db
+
+		if stmt, err = ps.primaryStmt(db); err != nil {
+			sp.setError(err)
+			sp.finish()
+			return nil, withCode(errCodeDatabase, err)
+		}
+	}
+
+	st := time.Now()
+
+	_, err = stmt.QueryOne(pg.Scan(&root), vars...)
+	sp.setError(err)
+	sp.finish()
+
+	c.metrics.sql(true, st)
+	c.slowQuery(db, st, ps.sql, ps.sql, vars)
+	if len(ps.item.Name) != 0 {
+		c.metrics.preparedStmt(ps.item.Name)
+	} else {
+		c.metrics.preparedStmt(ps.item.Hash)
+	}
+
 	if err != nil {
-		return nil, nil, err
+		return nil, withCode(errCodeDatabase, err)
 	}
 
-	fmt.Printf("PRE: %#v %#v\n", ps.stmt, vars)
+	c.traceSelects(ps.qc.Query.Selects, ps.skip, st)
+
+	c.dbLog.Debug().
+		Str("request_id", c.reqID).
+		Str("sql", ps.sql).
+		Strs("args", ps.args).
+		Msg("prepared statement")
 
-	return []byte(root), ps, nil
+	return []byte(root), nil
+}
+
+// checkAllowItem enforces the role and required variables
+// set on a query in the allow list
+func (c *coreContext) checkAllowItem(item *allowItem) error {
+	if item.Role == roleUser && c.Value(userIDKey) == nil {
+		return errUnauthorized
+	}
+
+	for _, v := range item.Vars {
+		// set by the server and never by the client
+		if serverVar(v) {
+			continue
+		}
+		if _, ok := c.conf.DB.vars[strings.ToLower(v)]; ok {
+			continue
+		}
+		if _, ok := c.req.Vars[v]; ok {
+			continue
+		}
+		if _, ok := c.req.Vars[strings.ToLower(v)]; ok {
+			continue
+		}
+		return withCode(errCodeValidation, fmt.Errorf("variable '%s' is required", v))
+	}
+
+	return nil
 }
 
 func (c *coreContext) resolveSQL(qc *qcode.QCode) (
-	[]byte, uint32, error) {
+	[]byte, []psql.Skip, error) {
 
 	stmt := &bytes.Buffer{}
 
-	skipped, err := pcompile.Compile(qc, stmt)
+	_, sp := startSpan(c, "psql.compile")
+	st := time.Now()
+
+	skip, err := c.pcompile.Compile(qc, stmt)
+	c.tracePhase(phaseValidation, st)
+
+	sp.setError(err)
+	sp.finish()
+
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, withCode(errCodeValidation, err)
 	}
 
-	t := fasttemplate.New(stmt.String(), openVar, closeVar)
+	c.userScoped = bytes.Contains(stmt.Bytes(), []byte(openVar+"user_id"))
+
+	// variables are left out of the logged sql as they can hold
+	// user data
+	tmpl := stmt.String()
+	t := fasttemplate.New(tmpl, openVar, closeVar)
 
 	stmt.Reset()
 	_, err = t.Execute(stmt, varMap(c))
 
 	if err == errNoUserID &&
-		authFailBlock == authFailBlockPerQuery &&
+		c.authFailBlock == authFailBlockPerQuery &&
 		authCheck(c) == false {
-		return nil, 0, errUnauthorized
+		return nil, nil, errUnauthorized
 	}
 
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, err
 	}
 
 	finalSQL := stmt.String()
 
-	if conf.LogLevel == "debug" {
-		os.Stdout.WriteString(finalSQL)
-	}
+	c.dbLog.Debug().
+		Str("request_id", c.reqID).
+		Str("sql", tmpl).
+		Msg("query")
 
-	var st time.Time
+	st = time.Now()
 
-	if conf.EnableTracing {
-		st = time.Now()
-	}
+	_, sp = startSpan(c, "db.query")
+	sp.setAttr("db.system", "postgresql")
+
+	db := c.db
 
-	fmt.Printf("RAW: %#v\n", finalSQL)
+	r := c.readReplica()
+	defer r.done()
+
+	if r != nil {
+		db = r.db
+		sp.setAttr("db.replica", r.name)
+	}
 
 	var root json.RawMessage
 	_, err = db.QueryOne(pg.Scan(&root), finalSQL)
+	sp.setError(err)
+	sp.finish()
+
+	c.metrics.sql(false, st)
+	c.slowQuery(db, st, tmpl, finalSQL, nil)
 
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, withCode(errCodeDatabase, err)
 	}
 
-	if conf.EnableTracing && len(qc.Query.Selects) != 0 {
-		c.addTrace(
-			qc.Query.Selects,
-			qc.Query.Selects[0].ID,
-			st)
-	}
+	c.traceSelects(qc.Query.Selects, skip, st)
 
-	if conf.UseAllowList == false {
-		_allowList.add(&c.req)
+	if c.conf.UseAllowList == false {
+		c.allowList.add(&c.req)
 	}
 
-	return []byte(root), skipped, nil
+	return []byte(root), skip, nil
 }
 
 func (c *coreContext) render(w io.Writer, data []byte) error {
@@ -336,94 +664,310 @@ func (c *coreContext) render(w io.Writer, data []byte) error {
 	return json.NewEncoder(w).Encode(c.res)
 }
 
-func (c *coreContext) addTrace(sel []qcode.Select, id int32, st time.Time) {
-	et := time.Now()
-	du := et.Sub(st)
+func (c *coreContext) addCost(qcost *queryCost) {
+	if qcost == nil {
+		return
+	}
 
 	if c.res.Extensions == nil {
-		c.res.Extensions = &extensions{&trace{
-			Version:   1,
-			StartTime: st,
-			Execution: execution{},
-		}}
+		c.res.Extensions = &extensions{}
 	}
+	c.res.Extensions.Cost = qcost
+}
 
-	c.res.Extensions.Tracing.EndTime = et
-	c.res.Extensions.Tracing.Duration = du
+// startTracing starts the apollo tracing for the request, the
+// offsets of all the phases and resolvers are from now
+func (c *coreContext) startTracing() {
+	if c.res.Extensions == nil {
+		c.res.Extensions = &extensions{}
+	}
 
-	n := 1
-	for i := id; i != 0; i = sel[i].ParentID {
-		n++
+	c.res.Extensions.Tracing = &trace{
+		Version:   1,
+		StartTime: time.Now(),
+		Execution: execution{Resolvers: []resolver{}},
 	}
-	path := make([]string, n)
+}
 
-	n--
-	for i := id; ; i = sel[i].ParentID {
-		path[n] = sel[i].Table
-		if sel[i].ID == 0 {
-			break
+func (c *coreContext) endTracing() {
+	c.resMu.Lock()
+	defer c.resMu.Unlock()
+
+	tr := c.res.Extensions.Tracing
+	tr.EndTime = time.Now()
+	tr.Duration = tr.EndTime.Sub(tr.StartTime)
+}
+
+func (c *coreContext) tracing() *trace {
+	if c.res.Extensions == nil {
+		return nil
+	}
+	return c.res.Extensions.Tracing
+}
+
+const (
+	phaseParsing = iota
+	phaseValidation
+)
+
+// tracePhase records the parsing or validation phase started at st,
+// validation is done by both compilers so it can be extended
+func (c *coreContext) tracePhase(ph int, st time.Time) {
+	tr := c.tracing()
+	if tr == nil {
+		return
+	}
+
+	p := &tr.Parsing
+	if ph == phaseValidation {
+		p = &tr.Validation
+	}
+
+	if *p == nil {
+		*p = &phase{StartOffset: st.Sub(tr.StartTime)}
+	}
+	(*p).Duration = time.Since(tr.StartTime) - (*p).StartOffset
+}
+
+// traceSelects records a resolver for each select fetched by the
+// database query started at st
+func (c *coreContext) traceSelects(sel []qcode.Select, skip []psql.Skip, st time.Time) {
+	if c.tracing() == nil {
+		return
+	}
+
+	for i := range sel {
+		if i < len(skip) && skip[i].Type != psql.SkipNone {
+			continue
 		}
-		n--
+		c.addTrace(sel, sel[i].ID, fieldPath(sel, sel[i].ID), st, time.Since(st), nil)
+	}
+}
+
+// addRemoteTrace records a resolver for the remote field at the n'th
+// insertion point, it's also recorded when the remote fails
+func (c *coreContext) addRemoteTrace(sel []qcode.Select, n int, rs *remoteSel,
+	st time.Time, data []byte) {
+	if c.tracing() == nil {
+		return
+	}
+	du := time.Since(st)
+
+	c.addTrace(sel, rs.sel.ID, c.remotePath(n, rs), st, du, data)
+}
+
+// addTrace records a resolver at path for the select that started at
+// st and took du, data is the response for remote selects. It's
+// called from the goroutines fetching remotes.
+func (c *coreContext) addTrace(sel []qcode.Select, id int32, path []interface{},
+	st time.Time, du time.Duration, data []byte) {
+	tr := c.tracing()
+	if tr == nil {
+		return
+	}
+
+	s := &sel[id]
+	pt := "Query"
+
+	if s.ID != 0 {
+		pt, _ = c.fieldType(&sel[s.ParentID], nil)
+	}
+
+	rt, list := c.fieldType(s, data)
+	if list {
+		rt = "[" + rt + "]"
 	}
 
-	tr := resolver{
+	c.resMu.Lock()
+	defer c.resMu.Unlock()
+
+	tr.Execution.Resolvers = append(tr.Execution.Resolvers, resolver{
 		Path:        path,
-		ParentType:  "Query",
-		FieldName:   sel[id].Table,
-		ReturnType:  "object",
-		StartOffset: 1,
+		ParentType:  pt,
+		FieldName:   s.Table,
+		ReturnType:  rt,
+		StartOffset: st.Sub(tr.StartTime),
 		Duration:    du,
+	})
+}
+
+// fieldType returns the graphql type of a select and if it's a list,
+// remotes are not in the database schema so their type is from the
+// name of the remote and if it's data is a list
+func (c *coreContext) fieldType(s *qcode.Select, data []byte) (string, bool) {
+	if data == nil {
+		if tn, list, err := c.pcompile.FieldType(s.Table); err == nil {
+			return tn, list
+		}
 	}
 
-	c.res.Extensions.Tracing.Execution.Resolvers =
-		append(c.res.Extensions.Tracing.Execution.Resolvers, tr)
+	return flect.Pascalize(flect.Singularize(s.Table)), len(data) != 0 && data[0] == '['
 }
 
-func parentFieldIds(h *xxhash.Digest, sel []qcode.Select, skipped uint32) (
-	[][]byte,
-	map[uint64]*qcode.Select) {
+// newRemoteReq returns the request for the value of a marked insertion
+// point, it's either the id or an object with the id and the other
+// columns of the remote. It's nil when there is no id.
+func (c *coreContext) newRemoteReq(req *http.Request, r *resolvFn, v []byte) *remoteReq {
+	rr := &remoteReq{ctx: c.Context, inReq: req}
 
-	c := 0
-	for i := range sel {
-		s := &sel[i]
-		if isSkipped(skipped, uint32(s.ID)) {
-			c++
+	if len(v) != 0 && v[0] == '{' {
+		var m map[string]json.RawMessage
+
+		if err := json.Unmarshal(v, &m); err != nil {
+			return nil
 		}
+
+		rr.cols = make(map[string][]byte, len(m))
+		for k, cv := range m {
+			rr.cols[k] = jsn.Value(cv)
+		}
+		rr.id = rr.cols[r.IDCol]
+
+	} else if len(v) != 0 {
+		rr.id = jsn.Value(v)
+	}
+
+	if len(rr.id) == 0 || bytes.Equal(rr.id, []byte("null")) {
+		return nil
 	}
 
-	// list of keys (and it's related value) to extract from
-	// the db json response
-	fm := make([][]byte, c)
+	return rr
+}
 
-	// mapping between the above extracted key and a Select
-	// object
-	sm := make(map[uint64]*qcode.Select, c)
-	n := 0
+// remoteSel is a select fetched from a remote api, path is where
+// it's field is in the response
+type remoteSel struct {
+	sel  *qcode.Select
+	r    *resolvFn
+	path []interface{}
+}
 
-	for i := range sel {
+// remoteSelects returns the keys in the database response that
+// hold the ids for the remote selects and the remote select for
+// each of these keys. Each remote select has it's own key so the
+// same remote can be used at several places in a query.
+func remoteSelects(sel []qcode.Select, skip []psql.Skip,
+	rmap map[uint64]*resolvFn) ([][]byte, map[uint64]*remoteSel) {
+
+	h := xxhash.New()
+
+	var keys [][]byte
+	rsmap := make(map[uint64]*remoteSel)
+
+	for i := range skip {
+		if skip[i].Type != psql.SkipRemote {
+			continue
+		}
 		s := &sel[i]
+		p := sel[s.ParentID]
 
-		if isSkipped(skipped, uint32(s.ID)) == false {
+		// use the table name in the select and it's parent
+		// to find the resolver to use for this relationship
+		r, ok := rmap[mkkey(h, s.Table, p.Table)]
+		if !ok {
 			continue
 		}
 
-		p := sel[s.ParentID]
-		k := mkkey(h, s.Table, p.Table)
+		keys = append(keys, skip[i].IDKey)
+		rsmap[xxhash.Sum64(skip[i].IDKey)] = &remoteSel{s, r, fieldPath(sel, s.ID)}
+	}
 
-		if r, ok := rmap[k]; ok {
-			fm[n] = r.IDField
-			n++
+	return keys, rsmap
+}
+
+// fieldPath returns the path to the field of a select in
+// the response, it has no list indexes
+func fieldPath(sel []qcode.Select, id int32) []interface{} {
+	n := 1
+	for i := id; i != 0; i = sel[i].ParentID {
+		n++
+	}
+	path := make([]interface{}, n)
 
-			k := xxhash.Sum64(r.IDField)
-			sm[k] = s
+	for i := id; ; i = sel[i].ParentID {
+		n--
+		path[n] = sel[i].FieldName
+		if sel[i].ID == 0 {
+			break
 		}
 	}
 
-	return fm, sm
+	return path
+}
+
+// remotePaths finds the paths in the response to the insertion points
+// found by jsn.Get, the response is only walked once a path is needed
+type remotePaths struct {
+	once  sync.Once
+	data  []byte
+	keys  [][]byte
+	paths [][]interface{}
+}
+
+// get returns the path to the n'th insertion point, nil when unknown
+func (rp *remotePaths) get(n int) []interface{} {
+	if rp == nil {
+		return nil
+	}
+
+	rp.once.Do(func() {
+		km := make(map[string]struct{}, len(rp.keys))
+		for _, k := range rp.keys {
+			km[string(k)] = struct{}{}
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(rp.data))
+		if err := walkPaths(dec, nil, km, &rp.paths); err != nil {
+			rp.paths = nil
+		}
+	})
+
+	if n >= len(rp.paths) {
+		return nil
+	}
+	return rp.paths[n]
 }
 
-func isSkipped(n uint32, pos uint32) bool {
-	return ((n & (1 << pos)) != 0)
+// walkPaths adds the path of each key in km it finds in the json value
+// to paths, in the same order as jsn.Get finds them
+func walkPaths(dec *json.Decoder, path []interface{}, km map[string]struct{},
+	paths *[][]interface{}) error {
+
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch t {
+	case json.Delim('{'):
+		for dec.More() {
+			kt, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			k, _ := kt.(string)
+
+			p := append(path, k)
+			if _, ok := km[k]; ok {
+				*paths = append(*paths, append([]interface{}{}, p...))
+			}
+
+			if err := walkPaths(dec, p, km, paths); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if err := walkPaths(dec, append(path, i), km, paths); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	}
+
+	return err
 }
 
 func authCheck(ctx *coreContext) bool {
@@ -0,0 +1,236 @@
+package serv
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dosco/super-graph/jsn"
+	"github.com/dosco/super-graph/psql"
+	"github.com/dosco/super-graph/qcode"
+)
+
+func remoteTestContext(required bool) (*coreContext, []qcode.Select, map[uint64]*remoteSel) {
+	if logger == nil {
+		logger = initLog()
+	}
+	h := xxhash.New()
+
+	sel := []qcode.Select{
+		{ID: 0, Table: "users", FieldName: "users"},
+		{ID: 1, ParentID: 0, Table: "payments", FieldName: "payments",
+			Cols: []qcode.Column{{Name: "amount", FieldName: "amount"}}},
+	}
+
+	rf := &resolvFn{
+		Required: required,
+		Fn: func(rr *remoteReq) ([]byte, error) {
+			if string(rr.id) == "2" {
+				return nil, errors.New("server responded with a 500")
+			}
+			return []byte(`{"amount": 10, "currency": "usd"}`), nil
+		},
+	}
+
+	c := &coreContext{SuperGraph: &SuperGraph{log: testLog()}, snapshot: &snapshot{
+		conf: &Config{},
+		rmap: map[uint64]*resolvFn{mkkey(h, "payments", "users"): rf},
+	}}
+
+	skip := []psql.Skip{{}, {Type: psql.SkipRemote, IDKey: []byte("__users_id_1")}}
+	_, rsmap := remoteSelects(sel, skip, c.rmap)
+
+	return c, sel, rsmap
+}
+
+func TestRemotePartialResult(t *testing.T) {
+	data := []byte(`{"users": [{"id": 1, "__users_id_1": 1}, {"id": 2, "__users_id_1": 2}]}`)
+	keys := [][]byte{[]byte("__users_id_1")}
+
+	c, sel, rsmap := remoteTestContext(false)
+	c.rpaths = &remotePaths{data: data, keys: keys}
+	from := jsn.Get(data, keys)
+
+	to, err := c.resolveRemotes(nil, from, sel, rsmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ob bytes.Buffer
+
+	if err := jsn.Replace(&ob, data, from, to); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := `{"users": [{"id": 1, "payments":{"amount": 10}}, {"id": 2, "payments":null}]}`
+	if ob.String() != exp {
+		t.Errorf("expecting %s got %s", exp, ob.String())
+	}
+
+	if len(c.res.Errors) != 1 {
+		t.Fatalf("expecting 1 error got %d", len(c.res.Errors))
+	}
+
+	ge := c.res.Errors[0]
+
+	if !reflect.DeepEqual(ge.Path, []interface{}{"users", 1, "payments"}) {
+		t.Errorf("unexpected error path %v", ge.Path)
+	}
+
+	if ge.Extensions.Code != errCodeRemote {
+		t.Errorf("expecting code %s got %s", errCodeRemote, ge.Extensions.Code)
+	}
+}
+
+func TestRemoteRequired(t *testing.T) {
+	data := []byte(`[{"id": 1, "__users_id_1": 1}, {"id": 2, "__users_id_1": 2}]`)
+
+	c, sel, rsmap := remoteTestContext(true)
+	from := jsn.Get(data, [][]byte{[]byte("__users_id_1")})
+
+	_, err := c.resolveRemotes(nil, from, sel, rsmap)
+	if err == nil {
+		t.Fatal("expecting an error for a required remote")
+	}
+
+	if len(c.res.Errors) != 0 {
+		t.Errorf("expecting no partial errors got %d", len(c.res.Errors))
+	}
+}
+
+func TestRemoteSelects(t *testing.T) {
+	c, _, _ := remoteTestContext(false)
+
+	// the same remote under users and under their friends
+	sel := []qcode.Select{
+		{ID: 0, Table: "users", FieldName: "users"},
+		{ID: 1, ParentID: 0, Table: "payments", FieldName: "payments"},
+		{ID: 2, ParentID: 0, Table: "users", FieldName: "friends"},
+		{ID: 3, ParentID: 2, Table: "payments", FieldName: "payments"},
+	}
+
+	skip := []psql.Skip{
+		{},
+		{Type: psql.SkipRemote, IDKey: []byte("__users_id_1")},
+		{},
+		{Type: psql.SkipRemote, IDKey: []byte("__users_id_3")},
+	}
+
+	keys, rsmap := remoteSelects(sel, skip, c.rmap)
+
+	if len(keys) != 2 {
+		t.Fatalf("expecting 2 keys got %d", len(keys))
+	}
+
+	paths := map[string][]interface{}{
+		"__users_id_1": {"users", "payments"},
+		"__users_id_3": {"users", "friends", "payments"},
+	}
+
+	for k, path := range paths {
+		rs, ok := rsmap[xxhash.Sum64String(k)]
+		if !ok {
+			t.Fatalf("no remote select for %s", k)
+		}
+
+		if !reflect.DeepEqual(rs.path, path) {
+			t.Errorf("%s: expecting path %v got %v", k, path, rs.path)
+		}
+	}
+}
+
+func TestRemotePaths(t *testing.T) {
+	data := []byte(`{"users": [
+		{"id": 1, "__users_id_1": 1, "friends": [{"__users_id_3": 5}, {"__users_id_3": 6}]},
+		{"id": 2, "__users_id_1": {"id": 2, "ref": "a"}, "friends": []}
+	]}`)
+	keys := [][]byte{[]byte("__users_id_1"), []byte("__users_id_3")}
+
+	rp := &remotePaths{data: data, keys: keys}
+
+	exp := [][]interface{}{
+		{"users", 0, "__users_id_1"},
+		{"users", 0, "friends", 0, "__users_id_3"},
+		{"users", 0, "friends", 1, "__users_id_3"},
+		{"users", 1, "__users_id_1"},
+	}
+
+	from := jsn.Get(data, keys)
+	if len(from) != len(exp) {
+		t.Fatalf("expecting %d fields got %d", len(exp), len(from))
+	}
+
+	for i := range exp {
+		if p := rp.get(i); !reflect.DeepEqual(p, exp[i]) {
+			t.Errorf("expecting path %v got %v", exp[i], p)
+		}
+
+		if k := exp[i][len(exp[i])-1]; string(from[i].Key) != k {
+			t.Errorf("expecting key %s got %s", k, from[i].Key)
+		}
+	}
+
+	if p := rp.get(len(exp)); p != nil {
+		t.Errorf("expecting no path got %v", p)
+	}
+}
+
+func TestApolloTracing(t *testing.T) {
+	data := []byte(`{"users": [{"id": 1, "__users_id_1": 1}, {"id": 2, "__users_id_1": 2},
+		{"id": 3, "__users_id_1": 3}]}`)
+	keys := [][]byte{[]byte("__users_id_1")}
+
+	c, sel, rsmap := remoteTestContext(false)
+	c.rpaths = &remotePaths{data: data, keys: keys}
+	c.conf.EnableTracing = true
+	c.pcompile = psql.NewCompiler(psql.Config{Schema: &psql.DBSchema{}})
+
+	c.startTracing()
+	st := time.Now()
+
+	c.tracePhase(phaseParsing, st)
+	c.tracePhase(phaseValidation, st)
+	c.tracePhase(phaseValidation, st)
+
+	from := jsn.Get(data, keys)
+
+	if _, err := c.resolveRemotes(nil, from, sel, rsmap); err != nil {
+		t.Fatal(err)
+	}
+	c.endTracing()
+
+	tr := c.res.Extensions.Tracing
+
+	if tr.Parsing == nil || tr.Validation == nil || tr.Validation.StartOffset < 0 {
+		t.Fatal("expecting the parsing and validation phases")
+	}
+
+	// the failed remote has a resolver too
+	if len(tr.Execution.Resolvers) != 3 {
+		t.Fatalf("expecting 3 resolvers got %d", len(tr.Execution.Resolvers))
+	}
+
+	paths := make(map[int]bool)
+
+	for _, r := range tr.Execution.Resolvers {
+		if len(r.Path) != 3 || r.Path[0] != "users" || r.Path[2] != "payments" ||
+			r.ParentType != "User" || r.ReturnType != "Payment" {
+			t.Errorf("unexpected resolver %+v", r)
+			continue
+		}
+		if i, ok := r.Path[1].(int); ok {
+			paths[i] = true
+		}
+
+		if r.StartOffset < tr.Validation.StartOffset || r.StartOffset+r.Duration > tr.Duration {
+			t.Errorf("resolver %+v is outside the request", r)
+		}
+	}
+
+	if len(paths) != 3 || !paths[0] || !paths[1] || !paths[2] {
+		t.Errorf("expecting a resolver for each user got %v", paths)
+	}
+}
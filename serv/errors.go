@@ -0,0 +1,149 @@
+package serv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/dosco/super-graph/qcode"
+	"github.com/go-pg/pg"
+)
+
+// error codes returned in the extensions of each error, the apollo
+// client uses these to decide how to handle an error
+const (
+	errCodeParse             = "GRAPHQL_PARSE_FAILED"
+	errCodeValidation        = "GRAPHQL_VALIDATION_FAILED"
+	errCodeBadRequest        = "BAD_REQUEST"
+	errCodeUnauthenticated   = "UNAUTHENTICATED"
+	errCodeForbidden         = "FORBIDDEN"
+	errCodeRateLimited       = "RATE_LIMITED"
+	errCodeDatabase          = "DATABASE_ERROR"
+	errCodeRemote            = "REMOTE_ERROR"
+	errCodeInternal          = "INTERNAL_SERVER_ERROR"
+	errCodePersistedNotFound = "PERSISTED_QUERY_NOT_FOUND"
+)
+
+var (
+	errNotAllowed = errors.New("query not in the allow list")
+)
+
+type gqlError struct {
+	Message    string         `json:"message"`
+	Locations  []errLocation  `json:"locations,omitempty"`
+	Path       []interface{}  `json:"path,omitempty"`
+	Extensions *errExtensions `json:"extensions,omitempty"`
+}
+
+type errLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type errExtensions struct {
+	Code string `json:"code"`
+}
+
+// gqlErrors is returned by GraphQL along with the data when parts
+// of the response could not be resolved
+type gqlErrors []gqlError
+
+func (e gqlErrors) Error() string {
+	msg := make([]string, len(e))
+	for i := range e {
+		msg[i] = e[i].Message
+	}
+	return strings.Join(msg, "; ")
+}
+
+// codedError is an error with an error code
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func withCode(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	// keep the more specific code
+	if _, ok := err.(*codedError); ok {
+		return err
+	}
+	if _, ok := err.(*qcode.Error); ok {
+		return err
+	}
+
+	return &codedError{code, err}
+}
+
+func newGQLError(err error) gqlError {
+	ge := gqlError{Message: err.Error()}
+
+	switch e := err.(type) {
+	case *codedError:
+		ge.Extensions = &errExtensions{e.code}
+
+	case *qcode.Error:
+		ge.Message = e.Message
+		ge.Locations = []errLocation{{e.Line, e.Column}}
+		ge.Extensions = &errExtensions{errCodeParse}
+
+	case pg.Error:
+		ge.Extensions = &errExtensions{errCodeDatabase}
+
+	default:
+		switch err {
+		case errUnauthorized, errNoUserID:
+			ge.Extensions = &errExtensions{errCodeUnauthenticated}
+		case errNotAllowed:
+			ge.Extensions = &errExtensions{errCodeForbidden}
+		case errRateLimited:
+			ge.Extensions = &errExtensions{errCodeRateLimited}
+		default:
+			ge.Extensions = &errExtensions{errCodeInternal}
+		}
+	}
+
+	return ge
+}
+
+// errStatus returns the http status for an error code, errors while
+// running the query are returned with a 200 like other graphql servers
+func errStatus(code string) int {
+	switch code {
+	case errCodeParse, errCodeValidation, errCodeBadRequest:
+		return http.StatusBadRequest
+	case errCodeUnauthenticated:
+		return http.StatusUnauthorized
+	case errCodeForbidden:
+		return http.StatusForbidden
+	case errCodeRateLimited:
+		return http.StatusTooManyRequests
+	case errCodeInternal:
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// errorStatus returns the http status for an error
+func errorStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	return errStatus(newGQLError(err).Extensions.Code)
+}
+
+func errorResp(w http.ResponseWriter, err error) {
+	ge := newGQLError(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(errStatus(ge.Extensions.Code))
+	json.NewEncoder(w).Encode(gqlResp{Errors: []gqlError{ge}})
+}
@@ -0,0 +1,58 @@
+package serv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/dosco/super-graph/qcode"
+)
+
+func TestErrorResp(t *testing.T) {
+	tests := []struct {
+		err    error
+		code   string
+		status int
+	}{
+		{&qcode.Error{Message: "expecting a field name", Line: 2, Column: 5}, errCodeParse, 400},
+		{withCode(errCodeValidation, errors.New("too deep")), errCodeValidation, 400},
+		{errUnauthorized, errCodeUnauthenticated, 401},
+		{errNotAllowed, errCodeForbidden, 403},
+		{withCode(errCodeDatabase, errors.New("relation does not exist")), errCodeDatabase, 200},
+		{withCode(errCodeRemote, errors.New("payments: timeout")), errCodeRemote, 200},
+		{errors.New("something broke"), errCodeInternal, 500},
+	}
+
+	for _, v := range tests {
+		w := httptest.NewRecorder()
+		errorResp(w, v.err)
+
+		if w.Code != v.status {
+			t.Errorf("%s: expecting status %d got %d", v.code, v.status, w.Code)
+		}
+
+		var res gqlResp
+
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res.Errors) != 1 || res.Errors[0].Extensions.Code != v.code {
+			t.Errorf("expecting error code %s got %s", v.code, w.Body.String())
+		}
+	}
+}
+
+func TestErrorLocations(t *testing.T) {
+	ge := newGQLError(&qcode.Error{Message: "expecting a field name", Line: 2, Column: 5})
+
+	if ge.Message != "expecting a field name" {
+		t.Fatalf("unexpected message '%s'", ge.Message)
+	}
+
+	if !reflect.DeepEqual(ge.Locations, []errLocation{{2, 5}}) {
+		t.Fatalf("unexpected locations %v", ge.Locations)
+	}
+}
@@ -0,0 +1,279 @@
+package serv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dosco/super-graph/psql"
+	"github.com/dosco/super-graph/qcode"
+	"github.com/go-pg/pg"
+)
+
+const (
+	explainPlan    = "EXPLAIN (FORMAT JSON) "
+	explainAnalyze = "EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) "
+
+	// slow queries are run again by EXPLAIN ANALYZE, this stops
+	// them from holding a connection for long
+	explainTimeout = 10 * time.Second
+)
+
+type explainResp struct {
+	QCode     explainQCode    `json:"qcode"`
+	SQL       string          `json:"sql"`
+	Variables []explainVar    `json:"variables"`
+	Plan      json.RawMessage `json:"plan"`
+}
+
+type explainQCode struct {
+	Depth   int             `json:"depth"`
+	Cost    int             `json:"cost"`
+	Selects []explainSelect `json:"selects"`
+}
+
+type explainSelect struct {
+	ID         int32       `json:"id"`
+	ParentID   int32       `json:"parent_id"`
+	Table      string      `json:"table"`
+	FieldName  string      `json:"field_name"`
+	Columns    []string    `json:"columns"`
+	Where      *explainExp `json:"where,omitempty"`
+	OrderBy    []string    `json:"order_by,omitempty"`
+	DistinctOn []string    `json:"distinct_on,omitempty"`
+	Limit      string      `json:"limit,omitempty"`
+	Offset     string      `json:"offset,omitempty"`
+	Children   []int32     `json:"children,omitempty"`
+	Skip       string      `json:"skip,omitempty"`
+}
+
+type explainExp struct {
+	Op       string        `json:"op"`
+	Col      string        `json:"col,omitempty"`
+	Val      string        `json:"val,omitempty"`
+	Vals     []string      `json:"vals,omitempty"`
+	Children []*explainExp `json:"children,omitempty"`
+}
+
+type explainVar struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// explainHandler is the dev only endpoint that returns the compiled
+// query, sql, bind variables and query plan without running the query
+func (sg *SuperGraph) explainHandler(s *snapshot, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := &coreContext{Context: r.Context(), SuperGraph: sg, snapshot: s, reqID: requestID(r)}
+	w.Header().Set(requestIDHeader, ctx.reqID)
+
+	if s.authFailBlock == authFailBlockAlways && authCheck(ctx) == false {
+		errorResp(w, errUnauthorized)
+		return
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxReadBytes))
+	defer r.Body.Close()
+
+	if err != nil {
+		errorResp(w, withCode(errCodeBadRequest, err))
+		return
+	}
+
+	if err := json.Unmarshal(b, &ctx.req); err != nil {
+		errorResp(w, withCode(errCodeBadRequest, err))
+		return
+	}
+
+	res, err := ctx.explain()
+	if err != nil {
+		errorResp(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (c *coreContext) explain() (*explainResp, error) {
+	var qc *qcode.QCode
+	var skip []psql.Skip
+	var sql string
+	var args []string
+
+	// the same allow list role and variables checks as the query
+	if c.conf.UseAllowList {
+		ps, err := c.allowedItem([]byte(c.req.Query))
+		if err != nil {
+			return nil, err
+		}
+		qc, skip, sql, args = ps.qc, ps.skip, ps.sql, ps.args
+
+	} else {
+		op, err := qcode.ParseQuery([]byte(c.req.Query))
+		if err == nil {
+			qc, err = c.qcompile.CompileOperation(op)
+		}
+		if err != nil {
+			return nil, withCode(errCodeValidation, err)
+		}
+
+		var stmt []byte
+
+		skip, stmt, err = c.pcompile.CompileEx(qc)
+		if err != nil {
+			return nil, withCode(errCodeValidation, err)
+		}
+		sql, args = bindVars(string(stmt))
+	}
+
+	res := &explainResp{
+		QCode:     newExplainQCode(qc, skip),
+		SQL:       sql,
+		Variables: make([]explainVar, len(args)),
+	}
+
+	// missing variables are sent as null so the query can
+	// still be planned
+	vals := make([]interface{}, len(args))
+
+	for i, a := range args {
+		if v := varList(c, []string{a}); len(v) != 0 {
+			vals[i] = v[0]
+		}
+		res.Variables[i] = explainVar{a, vals[i]}
+	}
+
+	plan, err := explainQuery(c.db, explainPlan, sql, vals)
+	if err != nil {
+		return nil, withCode(errCodeDatabase, err)
+	}
+	res.Plan = plan
+
+	return res, nil
+}
+
+// explainQuery runs the EXPLAIN in a transaction that is rolled back
+// since with ANALYZE it executes the query and that would run
+// mutations again
+func explainQuery(db *pg.DB, prefix, query string, args []interface{}) (json.RawMessage, error) {
+	tx, err := db.WithTimeout(explainTimeout + time.Second).Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d",
+		explainTimeout/time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+
+	var plan json.RawMessage
+
+	if len(args) == 0 {
+		_, err = tx.QueryOne(pg.Scan(&plan), prefix+query)
+		return plan, err
+	}
+
+	stmt, err := tx.Prepare(prefix + query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.QueryOne(pg.Scan(&plan), args...)
+	return plan, err
+}
+
+func newExplainQCode(qc *qcode.QCode, skip []psql.Skip) explainQCode {
+	q := qc.Query
+
+	res := explainQCode{
+		Depth:   q.Depth,
+		Cost:    q.Cost,
+		Selects: make([]explainSelect, len(q.Selects)),
+	}
+
+	for i := range q.Selects {
+		s := &q.Selects[i]
+
+		es := explainSelect{
+			ID:         s.ID,
+			ParentID:   s.ParentID,
+			Table:      s.Table,
+			FieldName:  s.FieldName,
+			Columns:    make([]string, len(s.Cols)),
+			Where:      newExplainExp(s.Where),
+			DistinctOn: s.DistinctOn,
+			Limit:      s.Paging.Limit,
+			Offset:     s.Paging.Offset,
+			Children:   s.Children,
+		}
+
+		for n, col := range s.Cols {
+			es.Columns[n] = col.Name
+		}
+
+		for _, ob := range s.OrderBy {
+			es.OrderBy = append(es.OrderBy, ob.Col+" "+orderName(ob.Order))
+		}
+
+		if int(s.ID) < len(skip) {
+			switch skip[s.ID].Type {
+			case psql.SkipRemote:
+				es.Skip = "remote"
+			case psql.SkipNoRel:
+				es.Skip = "no_relationship"
+			}
+		}
+
+		res.Selects[i] = es
+	}
+
+	return res
+}
+
+func newExplainExp(ex *qcode.Exp) *explainExp {
+	if ex == nil {
+		return nil
+	}
+
+	e := &explainExp{
+		Op:   strings.Trim(ex.Op.String(), "<>"),
+		Col:  ex.Col,
+		Val:  ex.Val,
+		Vals: ex.ListVal,
+	}
+
+	for _, v := range ex.Children {
+		e.Children = append(e.Children, newExplainExp(v))
+	}
+
+	return e
+}
+
+func orderName(o qcode.Order) string {
+	switch o {
+	case qcode.OrderAsc:
+		return "asc"
+	case qcode.OrderDesc:
+		return "desc"
+	case qcode.OrderAscNullsFirst:
+		return "asc_nulls_first"
+	case qcode.OrderAscNullsLast:
+		return "asc_nulls_last"
+	case qcode.OrderDescNullsFirst:
+		return "desc_nulls_first"
+	case qcode.OrderDescNullsLast:
+		return "desc_nulls_last"
+	}
+	return ""
+}
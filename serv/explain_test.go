@@ -0,0 +1,133 @@
+package serv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dosco/super-graph/psql"
+	"github.com/dosco/super-graph/qcode"
+)
+
+func TestBindVars(t *testing.T) {
+	sql, args := bindVars(`SELECT 1 WHERE id = ('{{id}}') AND user_id = ('{{user_id}}')`)
+
+	if sql != `SELECT 1 WHERE id = $1 AND user_id = $2` {
+		t.Errorf("unexpected sql %s", sql)
+	}
+
+	if len(args) != 2 || args[0] != "id" || args[1] != "user_id" {
+		t.Errorf("expecting id and user_id got %v", args)
+	}
+}
+
+func TestExplainQCode(t *testing.T) {
+	qcompile, err := qcode.NewCompiler(qcode.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qc, err := qcompile.CompileQuery([]byte(`{
+		products(where: { price: { gt: $price } }, order_by: { price: desc }, limit: 5) {
+			id
+			name
+			user {
+				email
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	skip := []psql.Skip{{}, {Type: psql.SkipRemote}}
+	res := newExplainQCode(qc, skip)
+
+	if len(res.Selects) != 2 {
+		t.Fatalf("expecting 2 selects got %d", len(res.Selects))
+	}
+
+	s := res.Selects[0]
+
+	if s.Table != "products" || strings.Join(s.Columns, ",") != "id,name" || s.Limit != "5" {
+		t.Errorf("unexpected select %+v", s)
+	}
+
+	if s.Where == nil || s.Where.Op != "op-greater-than" || s.Where.Col != "price" || s.Where.Val != "price" {
+		t.Errorf("unexpected where %+v", s.Where)
+	}
+
+	if len(s.OrderBy) != 1 || s.OrderBy[0] != "price desc" {
+		t.Errorf("unexpected order by %v", s.OrderBy)
+	}
+
+	if res.Selects[1].Skip != "remote" || res.Selects[1].ParentID != 0 {
+		t.Errorf("unexpected child select %+v", res.Selects[1])
+	}
+}
+
+func TestExplainHandler(t *testing.T) {
+	qcompile, err := qcode.NewCompiler(qcode.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sg := &SuperGraph{log: testLog()}
+	s := &snapshot{conf: &Config{}, qcompile: qcompile}
+
+	w := httptest.NewRecorder()
+	sg.explainHandler(s, w, httptest.NewRequest("GET", "/api/v1/explain", nil))
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expecting a 405 got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	sg.explainHandler(s, w, httptest.NewRequest("POST", "/api/v1/explain",
+		strings.NewReader(`{"query": "{ products(where: ) }"}`)))
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"errors"`) {
+		t.Errorf("expecting an error got %d %s", w.Code, w.Body.String())
+	}
+
+	if w.Header().Get(requestIDHeader) == "" {
+		t.Error("expecting a request id header")
+	}
+
+	s.authFailBlock = authFailBlockAlways
+
+	w = httptest.NewRecorder()
+	sg.explainHandler(s, w, httptest.NewRequest("POST", "/api/v1/explain",
+		strings.NewReader(`{"query": "{ products { id } }"}`)))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expecting a 401 without a user got %d", w.Code)
+	}
+}
+
+func TestExplainAllowList(t *testing.T) {
+	q := `query getProducts { products { id } }`
+
+	c := &coreContext{
+		Context:    context.Background(),
+		SuperGraph: &SuperGraph{log: testLog()},
+		snapshot: &snapshot{
+			conf: &Config{UseAllowList: true},
+			preparedList: map[string]*preparedItem{gqlHash([]byte(q)): {
+				item: &allowItem{Role: roleUser}}},
+		},
+	}
+	c.req.Query = q
+
+	if _, err := c.explain(); err != errUnauthorized {
+		t.Errorf("expecting anonymous requests to be unauthorized got %v", err)
+	}
+
+	c.req.Query = `{ users { id } }`
+
+	if _, err := c.explain(); err != errNotAllowed {
+		t.Errorf("expecting queries not in the allow list to fail got %v", err)
+	}
+}
@@ -26,30 +26,57 @@ var (
 )
 
 type gqlReq struct {
-	OpName string    `json:"operationName"`
-	Query  string    `json:"query"`
-	Vars   variables `json:"variables"`
-	ref    string
+	OpName     string         `json:"operationName"`
+	Query      string         `json:"query"`
+	Vars       variables      `json:"variables"`
+	Extensions *reqExtensions `json:"extensions"`
+	ref        string
+}
+
+type reqExtensions struct {
+	PersistedQuery *persistedQuery `json:"persistedQuery"`
+}
+
+type persistedQuery struct {
+	Version    int    `json:"version"`
+	Sha256Hash string `json:"sha256Hash"`
 }
 
 type variables map[string]interface{}
 
 type gqlResp struct {
-	Error      string          `json:"error,omitempty"`
+	Errors     []gqlError      `json:"errors,omitempty"`
 	Data       json.RawMessage `json:"data"`
 	Extensions *extensions     `json:"extensions,omitempty"`
 }
 
 type extensions struct {
-	Tracing *trace `json:"tracing,omitempty"`
+	Tracing *trace     `json:"tracing,omitempty"`
+	Cost    *queryCost `json:"cost,omitempty"`
 }
 
+type queryCost struct {
+	Cost    int `json:"cost"`
+	MaxCost int `json:"maxCost,omitempty"`
+	Depth   int `json:"depth"`
+	Selects int `json:"selects"`
+}
+
+// trace is the apollo tracing extension, offsets and durations are
+// in nanoseconds from the start of the request
 type trace struct {
-	Version   int           `json:"version"`
-	StartTime time.Time     `json:"startTime"`
-	EndTime   time.Time     `json:"endTime"`
-	Duration  time.Duration `json:"duration"`
-	Execution execution     `json:"execution"`
+	Version    int           `json:"version"`
+	StartTime  time.Time     `json:"startTime"`
+	EndTime    time.Time     `json:"endTime"`
+	Duration   time.Duration `json:"duration"`
+	Parsing    *phase        `json:"parsing,omitempty"`
+	Validation *phase        `json:"validation,omitempty"`
+	Execution  execution     `json:"execution"`
+}
+
+type phase struct {
+	StartOffset time.Duration `json:"startOffset"`
+	Duration    time.Duration `json:"duration"`
 }
 
 type execution struct {
@@ -57,21 +84,31 @@ type execution struct {
 }
 
 type resolver struct {
-	Path        []string      `json:"path"`
+	Path        []interface{} `json:"path"`
 	ParentType  string        `json:"parentType"`
 	FieldName   string        `json:"fieldName"`
 	ReturnType  string        `json:"returnType"`
-	StartOffset int           `json:"startOffset"`
+	StartOffset time.Duration `json:"startOffset"`
 	Duration    time.Duration `json:"duration"`
 }
 
-func apiv1Http(w http.ResponseWriter, r *http.Request) {
-	ctx := &coreContext{Context: r.Context()}
+func (sg *SuperGraph) apiv1Http(s *snapshot, w http.ResponseWriter, r *http.Request) {
+	tctx, sp := sg.tracer.startTrace(r.Context(), r.Header.Get(traceparentHeader), "graphql")
+	defer sp.finish()
+
+	sp.setAttr("http.method", r.Method)
+	sp.setAttr("http.target", r.URL.Path)
+
+	if readPrimary(r) {
+		tctx = WithReadPrimary(tctx)
+	}
 
-	if authFailBlock == authFailBlockAlways && authCheck(ctx) == false {
-		err := "Not authorized"
-		logger.Debug().Msg(err)
-		http.Error(w, err, 401)
+	ctx := &coreContext{Context: tctx, SuperGraph: sg, snapshot: s, reqID: requestID(r)}
+	w.Header().Set(requestIDHeader, ctx.reqID)
+
+	if s.authFailBlock == authFailBlockAlways && authCheck(ctx) == false {
+		sg.log.Debug().Str("request_id", ctx.reqID).Msg("Not authorized")
+		errorResp(w, errUnauthorized)
 		return
 	}
 
@@ -79,19 +116,37 @@ func apiv1Http(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	if err != nil {
-		logger.Err(err).Msg("failed to read request body")
-		errorResp(w, err)
+		sg.log.Err(err).Str("request_id", ctx.reqID).Msg("failed to read request body")
+		errorResp(w, withCode(errCodeBadRequest, err))
 		return
 	}
 
 	err = json.Unmarshal(b, &ctx.req)
 
 	if err != nil {
-		logger.Err(err).Msg("failed to decode json request body")
+		sg.log.Err(err).Str("request_id", ctx.reqID).Msg("failed to decode json request body")
+		errorResp(w, withCode(errCodeBadRequest, err))
+		return
+	}
+	setOpName(w, ctx.req.OpName)
+
+	found, err := ctx.resolvePersistedQuery()
+
+	if err != nil {
 		errorResp(w, err)
 		return
 	}
 
+	// apollo clients look for this error to retry with the query
+	if !found {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(gqlResp{Errors: []gqlError{{
+			Message:    errPersistedQueryNotFound,
+			Extensions: &errExtensions{Code: errCodePersistedNotFound},
+		}}})
+		return
+	}
+
 	if strings.EqualFold(ctx.req.OpName, introspectionQuery) {
 		// dat, err := ioutil.ReadFile("test.schema")
 		// if err != nil {
@@ -132,21 +187,14 @@ func apiv1Http(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = ctx.handleReq(w, r)
-
-	if err == errUnauthorized {
-		err := "Not authorized"
-		logger.Debug().Msg(err)
-		http.Error(w, err, 401)
+	if len(ctx.req.OpName) != 0 {
+		sp.setAttr("graphql.operation.name", ctx.req.OpName)
 	}
 
+	err = ctx.handleReq(w, r)
+	sp.setError(err)
+
 	if err != nil {
-		logger.Err(err).Msg("Failed to handle request")
 		errorResp(w, err)
 	}
 }
-
-func errorResp(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusBadRequest)
-	json.NewEncoder(w).Encode(gqlResp{Error: err.Error()})
-}
@@ -0,0 +1,169 @@
+package serv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	maxRequestIDLen = 128
+)
+
+var (
+	logger *zerolog.Logger
+
+	// generated sql is logged using dbLogger so it can have it's own
+	// level set with database.log_level
+	dbLogger = zerolog.Nop()
+
+	// levels are changed on reload while logging
+	logLevel   = int32(zerolog.InfoLevel)
+	dbLogLevel = int32(zerolog.InfoLevel)
+)
+
+// initLog returns the logger used until the config is read
+func initLog() *zerolog.Logger {
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).
+		With().
+		Timestamp().
+		Caller().
+		Logger()
+
+	return &logger
+}
+
+// initLoggers sets up the loggers using the log_format and levels
+// in the config, json is the default format
+func initLoggers(c *Config) {
+	var out io.Writer = os.Stderr
+
+	if c.LogFormat == "console" {
+		out = zerolog.ConsoleWriter{Out: os.Stderr}
+	}
+
+	l := zerolog.New(&levelWriter{out, &logLevel}).
+		With().
+		Timestamp().
+		Caller().
+		Logger()
+
+	logger = &l
+
+	dbLogger = zerolog.New(&levelWriter{out, &dbLogLevel}).
+		With().
+		Timestamp().
+		Logger()
+
+	setLogLevel(c)
+}
+
+// setLogLevel sets the levels for the loggers, database.log_level
+// defaults to log_level
+func setLogLevel(c *Config) {
+	lvl := parseLogLevel(c.LogLevel, "log_level")
+	dbLvl := lvl
+
+	if len(c.DB.LogLevel) != 0 {
+		dbLvl = parseLogLevel(c.DB.LogLevel, "database.log_level")
+	}
+
+	atomic.StoreInt32(&logLevel, int32(lvl))
+	atomic.StoreInt32(&dbLogLevel, int32(dbLvl))
+
+	// the global level skips building events no logger will write
+	if dbLvl < lvl {
+		zerolog.SetGlobalLevel(dbLvl)
+	} else {
+		zerolog.SetGlobalLevel(lvl)
+	}
+}
+
+func parseLogLevel(s, name string) zerolog.Level {
+	switch s {
+	case "":
+		return zerolog.InfoLevel
+	case "disable", "disabled":
+		return zerolog.Disabled
+	}
+
+	lvl, err := zerolog.ParseLevel(s)
+	if err != nil {
+		logger.Error().Err(err).Msgf("error setting %s", name)
+		return zerolog.InfoLevel
+	}
+
+	return lvl
+}
+
+// levelWriter drops the log lines below it's level
+type levelWriter struct {
+	io.Writer
+	level *int32
+}
+
+func (w *levelWriter) WriteLevel(l zerolog.Level, p []byte) (int, error) {
+	if int32(l) < atomic.LoadInt32(w.level) {
+		return len(p), nil
+	}
+	return w.Write(p)
+}
+
+// requestID returns the id sent by the client or a proxy in front
+// of super graph, or a new id
+func requestID(r *http.Request) string {
+	if r != nil {
+		if id := r.Header.Get(requestIDHeader); len(id) != 0 && len(id) <= maxRequestIDLen {
+			return id
+		}
+	}
+
+	var b [8]byte
+	rand.Read(b[:])
+
+	return hex.EncodeToString(b[:])
+}
+
+// logRequest logs each query once it's done, n is the size of the
+// response data. Only the hash of the query is logged.
+func (c *coreContext) logRequest(st time.Time, n int, err error) {
+	var ev *zerolog.Event
+
+	switch {
+	case err != nil && errorStatus(err) >= http.StatusInternalServerError:
+		ev = c.log.Error().Err(err)
+	case err != nil:
+		ev = c.log.Info().Err(err)
+	default:
+		ev = c.log.Info()
+	}
+
+	ev = ev.Str("request_id", c.reqID).
+		Dur("duration", time.Since(st)).
+		Int("bytes", n)
+
+	if len(c.req.Query) != 0 {
+		ev = ev.Str("query_hash", gqlHash([]byte(c.req.Query)))
+	}
+
+	if len(c.req.OpName) != 0 {
+		ev = ev.Str("operation", c.req.OpName)
+	}
+
+	if v, ok := c.Value(userIDKey).(string); ok {
+		ev = ev.Str("user_id", v)
+	}
+
+	if len(c.res.Errors) != 0 {
+		ev = ev.Int("field_errors", len(c.res.Errors))
+	}
+
+	ev.Msg("query")
+}
@@ -0,0 +1,154 @@
+package serv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// testLog returns a logger that writes nothing
+func testLog() *zerolog.Logger {
+	l := zerolog.Nop()
+	return &l
+}
+
+// testLoggers logs to buffers till the returned func is called
+func testLoggers(c *Config) (*bytes.Buffer, *bytes.Buffer, func()) {
+	l, dl := logger, dbLogger
+	gl := zerolog.GlobalLevel()
+
+	restore := func() {
+		logger, dbLogger = l, dl
+		zerolog.SetGlobalLevel(gl)
+	}
+
+	var buf, dbBuf bytes.Buffer
+
+	nl := zerolog.New(&levelWriter{&buf, &logLevel})
+	logger = &nl
+	dbLogger = zerolog.New(&levelWriter{&dbBuf, &dbLogLevel})
+
+	setLogLevel(c)
+
+	return &buf, &dbBuf, restore
+}
+
+func TestLogLevels(t *testing.T) {
+	c := &Config{LogLevel: "warn"}
+	c.DB.LogLevel = "debug"
+
+	buf, dbBuf, restore := testLoggers(c)
+	defer restore()
+
+	logger.Info().Msg("info")
+	logger.Warn().Msg("warn")
+	dbLogger.Debug().Msg("sql")
+
+	if strings.Contains(buf.String(), `"info"`) || !strings.Contains(buf.String(), `"warn"`) {
+		t.Errorf("expecting only the warn line got %s", buf.String())
+	}
+
+	if !strings.Contains(dbBuf.String(), `"sql"`) {
+		t.Error("expecting the sql to be logged at database.log_level")
+	}
+
+	c.DB.LogLevel = ""
+	setLogLevel(c)
+	dbBuf.Reset()
+
+	dbLogger.Debug().Msg("sql")
+
+	if dbBuf.Len() != 0 {
+		t.Error("expecting database.log_level to default to log_level")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/v1/graphql", nil)
+	r.Header.Set(requestIDHeader, "abc-123")
+
+	if id := requestID(r); id != "abc-123" {
+		t.Errorf("expecting the request id from the header got %s", id)
+	}
+
+	r.Header.Set(requestIDHeader, strings.Repeat("a", maxRequestIDLen+1))
+
+	if id := requestID(r); len(id) != 16 {
+		t.Errorf("expecting a new request id got %s", id)
+	}
+
+	if requestID(nil) == requestID(nil) {
+		t.Error("expecting a different request id each time")
+	}
+}
+
+func TestLogRequest(t *testing.T) {
+	buf, _, restore := testLoggers(&Config{})
+	defer restore()
+
+	c := &coreContext{
+		Context:    context.WithValue(context.Background(), userIDKey, "5"),
+		SuperGraph: &SuperGraph{log: logger},
+		reqID:      "abc-123",
+	}
+	c.req.OpName = "getProducts"
+	c.req.Query = "query getProducts { products(where: { price: { gt: $price } }) { id } }"
+
+	c.logRequest(time.Now(), 10, errors.New("db down"))
+
+	var v map[string]interface{}
+
+	if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	if v["level"] != "error" || v["request_id"] != "abc-123" || v["operation"] != "getProducts" ||
+		v["user_id"] != "5" || v["bytes"] != float64(10) || v["error"] != "db down" {
+		t.Errorf("unexpected log line %s", buf.String())
+	}
+
+	if v["query_hash"] != gqlHash([]byte(c.req.Query)) {
+		t.Error("expecting the query hash to be logged")
+	}
+
+	if strings.Contains(buf.String(), "products") {
+		t.Error("expecting the query not to be logged")
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	_, _, restore := testLoggers(&Config{})
+	defer restore()
+
+	// the level is left to the callers logger when used as a library
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+
+	var buf1, buf2 bytes.Buffer
+	l := logger
+
+	sg1, sg2 := &SuperGraph{}, &SuperGraph{}
+	WithLogger(zerolog.New(&buf1))(sg1)
+	WithLogger(zerolog.New(&buf2))(sg2)
+
+	sg1.log.Info().Msg("info")
+	sg1.dbLog.Debug().Msg("sql")
+
+	if !strings.Contains(buf1.String(), `"info"`) || !strings.Contains(buf1.String(), `"sql"`) {
+		t.Errorf("expecting the log and the sql in the callers logger got %s", buf1.String())
+	}
+
+	if buf2.Len() != 0 {
+		t.Errorf("expecting each super graph to have it's own logger got %s", buf2.String())
+	}
+
+	if logger != l {
+		t.Error("expecting the package logger to be left as is")
+	}
+}
@@ -0,0 +1,321 @@
+package serv
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// limits the series per metric so clients sending lots of
+	// operation names can't use up the memory
+	maxMetricSeries = 1000
+	otherLabel      = "other"
+)
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// metrics are exposed in the prometheus text format on /metrics,
+// a nil metrics records nothing
+type metrics struct {
+	requests     *metricVec
+	reqDuration  *metricVec
+	sqlDuration  *metricVec
+	remoteDur    *metricVec
+	remoteErrors *metricVec
+	allowList    *metricVec
+	prepared     *metricVec
+}
+
+func newMetrics(c *Config) *metrics {
+	if !c.EnableMetrics {
+		return nil
+	}
+
+	return &metrics{
+		requests: newCounter("super_graph_requests_total",
+			"GraphQL requests by operation name and http status", "operation", "status"),
+
+		reqDuration: newHistogram("super_graph_request_duration_seconds",
+			"GraphQL request latency by operation name and http status", "operation", "status"),
+
+		sqlDuration: newHistogram("super_graph_sql_duration_seconds",
+			"SQL query latency", "prepared"),
+
+		remoteDur: newHistogram("super_graph_remote_duration_seconds",
+			"Remote join latency by remote", "remote"),
+
+		remoteErrors: newCounter("super_graph_remote_errors_total",
+			"Failed remote joins by remote", "remote"),
+
+		allowList: newCounter("super_graph_allow_list_total",
+			"Allow list lookups by result (hit or miss)", "result"),
+
+		prepared: newCounter("super_graph_prepared_statements_total",
+			"Executions of prepared statements by query name", "query"),
+	}
+}
+
+func (m *metrics) request(op string, status int, st time.Time) {
+	if m == nil {
+		return
+	}
+	s := strconv.Itoa(status)
+
+	m.requests.inc(op, s)
+	m.reqDuration.observe(time.Since(st).Seconds(), op, s)
+}
+
+func (m *metrics) sql(prepared bool, st time.Time) {
+	if m == nil {
+		return
+	}
+	m.sqlDuration.observe(time.Since(st).Seconds(), strconv.FormatBool(prepared))
+}
+
+func (m *metrics) remote(name string, st time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.remoteDur.observe(time.Since(st).Seconds(), name)
+
+	if err != nil {
+		m.remoteErrors.inc(name)
+	}
+}
+
+func (m *metrics) allowListLookup(hit bool) {
+	if m == nil {
+		return
+	}
+
+	if hit {
+		m.allowList.inc("hit")
+	} else {
+		m.allowList.inc("miss")
+	}
+}
+
+func (m *metrics) preparedStmt(name string) {
+	if m == nil {
+		return
+	}
+	m.prepared.inc(name)
+}
+
+// withMetrics records the count and latency of requests, the handler
+// sets the operation name on the metricsWriter
+func (sg *SuperGraph) withMetrics(next http.HandlerFunc) http.HandlerFunc {
+	if sg.metrics == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		mw := &metricsWriter{ResponseWriter: w, status: http.StatusOK}
+		st := time.Now()
+
+		next.ServeHTTP(mw, r)
+
+		sg.metrics.request(mw.op, mw.status, st)
+	}
+}
+
+// metricsWriter keeps the status code of the response and the
+// name of the operation in the request
+type metricsWriter struct {
+	http.ResponseWriter
+	status int
+	op     string
+}
+
+func (w *metricsWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func setOpName(w http.ResponseWriter, op string) {
+	if mw, ok := w.(*metricsWriter); ok {
+		mw.op = op
+	}
+}
+
+func (sg *SuperGraph) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	pl := len(sg.current().preparedList)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+
+	m := sg.metrics
+	for _, v := range []*metricVec{m.requests, m.reqDuration, m.sqlDuration,
+		m.remoteDur, m.remoteErrors, m.allowList, m.prepared} {
+		v.write(bw)
+	}
+
+	writeGauge(bw, "super_graph_prepared_statements",
+		"Prepared statements for the allow list", uint64(pl))
+
+	ps := sg.db.PoolStats()
+
+	writeCounter(bw, "super_graph_db_pool_hits_total",
+		"Times a free connection was found in the pool", uint64(ps.Hits))
+	writeCounter(bw, "super_graph_db_pool_misses_total",
+		"Times a free connection was not found in the pool", uint64(ps.Misses))
+	writeCounter(bw, "super_graph_db_pool_timeouts_total",
+		"Times a wait for a connection timed out", uint64(ps.Timeouts))
+	writeGauge(bw, "super_graph_db_pool_connections",
+		"Connections in the pool", uint64(ps.TotalConns))
+	writeGauge(bw, "super_graph_db_pool_idle_connections",
+		"Idle connections in the pool", uint64(ps.IdleConns))
+	writeCounter(bw, "super_graph_db_pool_stale_connections_total",
+		"Stale connections removed from the pool", uint64(ps.StaleConns))
+
+	bw.Flush()
+}
+
+func writeCounter(w *bufio.Writer, name, help string, v uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
+
+func writeGauge(w *bufio.Writer, name, help string, v uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+}
+
+// metricVec is a counter or histogram with a series for each
+// set of label values
+type metricVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	values  []string
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return &metricVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+}
+
+func newHistogram(name, help string, labels ...string) *metricVec {
+	m := newCounter(name, help, labels...)
+	m.buckets = latencyBuckets
+	return m
+}
+
+func (m *metricVec) inc(values ...string) {
+	m.observe(0, values...)
+}
+
+func (m *metricVec) observe(v float64, values ...string) {
+	m.Lock()
+	defer m.Unlock()
+
+	s := m.get(values)
+	s.count++
+	s.sum += v
+
+	for i, b := range m.buckets {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+}
+
+func (m *metricVec) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+
+	if s, ok := m.series[key]; ok {
+		return s
+	}
+
+	if len(m.series) >= maxMetricSeries {
+		values = make([]string, len(values))
+		for i := range values {
+			values[i] = otherLabel
+		}
+		key = strings.Join(values, "\xff")
+
+		if s, ok := m.series[key]; ok {
+			return s
+		}
+	}
+
+	s := &series{values: values}
+	if m.buckets != nil {
+		s.buckets = make([]uint64, len(m.buckets))
+	}
+	m.series[key] = s
+
+	return s
+}
+
+func (m *metricVec) write(w *bufio.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	typ := "counter"
+	if m.buckets != nil {
+		typ = "histogram"
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, typ)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := m.series[k]
+		lv := m.labelPairs(s.values)
+
+		if m.buckets == nil {
+			fmt.Fprintf(w, "%s{%s} %d\n", m.name, lv, s.count)
+			continue
+		}
+
+		for i, b := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", m.name, lv,
+				strconv.FormatFloat(b, 'g', -1, 64), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", m.name, lv, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", m.name, lv, strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", m.name, lv, s.count)
+	}
+}
+
+func (m *metricVec) labelPairs(values []string) string {
+	var sb strings.Builder
+
+	for i, l := range m.labels {
+		if i != 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(l)
+		sb.WriteString(`="`)
+		sb.WriteString(labelEscaper.Replace(values[i]))
+		sb.WriteByte('"')
+	}
+
+	return sb.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
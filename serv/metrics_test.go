@@ -0,0 +1,96 @@
+package serv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+func TestMetricHistogram(t *testing.T) {
+	m := newHistogram("test_seconds", "Test latency", "remote")
+
+	m.observe(0.02, "payments")
+	m.observe(3, "payments")
+	m.observe(0.5, `a"b`)
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	m.write(w)
+	w.Flush()
+
+	out := buf.String()
+
+	for _, v := range []string{
+		"# TYPE test_seconds histogram\n",
+		`test_seconds_bucket{remote="payments",le="0.01"} 0`,
+		`test_seconds_bucket{remote="payments",le="0.025"} 1`,
+		`test_seconds_bucket{remote="payments",le="5"} 2`,
+		`test_seconds_bucket{remote="payments",le="+Inf"} 2`,
+		`test_seconds_sum{remote="payments"} 3.02`,
+		`test_seconds_count{remote="payments"} 2`,
+		`test_seconds_count{remote="a\"b"} 1`,
+	} {
+		if !strings.Contains(out, v) {
+			t.Errorf("expecting %s in:\n%s", v, out)
+		}
+	}
+}
+
+func TestMetricSeriesLimit(t *testing.T) {
+	m := newCounter("test_total", "Test", "operation")
+
+	for i := 0; i < maxMetricSeries+10; i++ {
+		m.inc(fmt.Sprintf("op%d", i))
+	}
+
+	if len(m.series) != maxMetricSeries+1 {
+		t.Fatalf("expecting %d series got %d", maxMetricSeries+1, len(m.series))
+	}
+
+	if s := m.series[otherLabel]; s == nil || s.count != 10 {
+		t.Error("expecting the series over the limit to be counted as other")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	db := pg.Connect(&pg.Options{Addr: "localhost:1"})
+	defer db.Close()
+
+	conf := &Config{EnableMetrics: true}
+	sg := &SuperGraph{log: testLog(), db: db, metrics: newMetrics(conf)}
+	sg.snap.Store(&snapshot{refs: 1, conf: conf})
+
+	h := sg.withMetrics(func(w http.ResponseWriter, r *http.Request) {
+		setOpName(w, "getProducts")
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/v1/graphql", nil))
+
+	sg.metrics.remote("payments", time.Now(), statusError(500))
+	sg.metrics.allowListLookup(false)
+
+	w := httptest.NewRecorder()
+	sg.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	out := w.Body.String()
+
+	for _, v := range []string{
+		`super_graph_requests_total{operation="getProducts",status="400"} 1`,
+		`super_graph_request_duration_seconds_count{operation="getProducts",status="400"} 1`,
+		`super_graph_remote_errors_total{remote="payments"} 1`,
+		`super_graph_allow_list_total{result="miss"} 1`,
+		"super_graph_prepared_statements 0\n",
+		"# TYPE super_graph_db_pool_connections gauge\n",
+	} {
+		if !strings.Contains(out, v) {
+			t.Errorf("expecting %s in:\n%s", v, out)
+		}
+	}
+}
@@ -4,76 +4,161 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
 
+	"github.com/dosco/super-graph/psql"
 	"github.com/dosco/super-graph/qcode"
 	"github.com/go-pg/pg"
 	"github.com/valyala/fasttemplate"
 )
 
 type preparedItem struct {
-	stmt    *pg.Stmt
-	args    []string
-	skipped uint32
-	qc      *qcode.QCode
+	sql        string
+	args       []string
+	skip       []psql.Skip
+	qc         *qcode.QCode
+	userScoped bool
+	item       *allowItem
+
+	// prepared on the primary and the replicas when first used, each
+	// prepared statement holds on to a connection from the pool so
+	// a reload doesn't need one for every query in the allow list
+	mu     sync.Mutex
+	stmt   *pg.Stmt
+	rstmts map[*replica]*pg.Stmt
 }
 
-var (
-	_preparedList map[string]*preparedItem
-)
-
-func initPreparedList() {
-	_preparedList = make(map[string]*preparedItem)
+func initPreparedList(al *allowList, qcompile *qcode.Compiler,
+	pcompile *psql.Compiler) (map[string]*preparedItem, error) {
+	pl := make(map[string]*preparedItem)
 
-	for k, v := range _allowList.list {
-		err := prepareStmt(k, v.gql)
+	for _, v := range al.list {
+		ps, err := prepareStmt(v, qcompile, pcompile)
 		if err != nil {
-			panic(err)
+			closePreparedList(pl)
+			return nil, fmt.Errorf("allow list query %s %s: %s", v.Hash, v.Name, err)
+		}
+		if ps != nil {
+			pl[v.Hash] = ps
 		}
 	}
+
+	return pl, nil
+}
+
+func closePreparedList(pl map[string]*preparedItem) {
+	for _, v := range pl {
+		v.close()
+	}
+}
+
+func (ps *preparedItem) close() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.stmt != nil {
+		ps.stmt.Close()
+		ps.stmt = nil
+	}
+
+	for r, s := range ps.rstmts {
+		s.Close()
+		delete(ps.rstmts, r)
+	}
 }
 
-func prepareStmt(key, gql string) error {
-	if len(gql) == 0 || len(key) == 0 {
-		return nil
+func (ps *preparedItem) primaryStmt(db *pg.DB) (*pg.Stmt, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.stmt != nil {
+		return ps.stmt, nil
 	}
 
-	qc, err := qcompile.CompileQuery([]byte(gql))
+	s, err := db.Prepare(ps.sql)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	ps.stmt = s
 
-	buf := &bytes.Buffer{}
+	return s, nil
+}
+
+func (ps *preparedItem) replicaStmt(r *replica) (*pg.Stmt, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if s, ok := ps.rstmts[r]; ok {
+		return s, nil
+	}
 
-	skipped, err := pcompile.Compile(qc, buf)
+	s, err := r.db.Prepare(ps.sql)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	t := fasttemplate.New(buf.String(), `('{{`, `}}')`)
-	am := make([]string, 0, 5)
-	i := 0
+	if ps.rstmts == nil {
+		ps.rstmts = make(map[*replica]*pg.Stmt)
+	}
+	ps.rstmts[r] = s
 
-	finalSQL := t.ExecuteFuncString(func(w io.Writer, tag string) (int, error) {
-		am = append(am, tag)
-		i++
-		return w.Write([]byte(fmt.Sprintf("$%d", i)))
-	})
+	return s, nil
+}
+
+// prepareStmt compiles the query to the sql for the prepared statement,
+// it's prepared on the database when first used
+func prepareStmt(item *allowItem, qcompile *qcode.Compiler,
+	pcompile *psql.Compiler) (*preparedItem, error) {
+	if len(item.Query) == 0 || len(item.Hash) == 0 {
+		return nil, nil
+	}
 
+	qc, err := qcompile.CompileQuery([]byte(item.Query))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	pstmt, err := db.Prepare(finalSQL)
+	buf := &bytes.Buffer{}
+
+	skip, err := pcompile.Compile(qc, buf)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	finalSQL, am := bindVars(buf.String())
+
+	userScoped := false
+	for i := range am {
+		if strings.HasPrefix(strings.ToLower(am[i]), "user_id") {
+			userScoped = true
+		}
 	}
 
-	_preparedList[key] = &preparedItem{
-		stmt:    pstmt,
-		args:    am,
-		skipped: skipped,
-		qc:      qc,
+	ps := &preparedItem{
+		sql:        finalSQL,
+		args:       am,
+		skip:       skip,
+		qc:         qc,
+		userScoped: userScoped,
+		item:       item,
 	}
 
-	return nil
+	return ps, nil
+}
+
+// bindVars replaces the variables in the sql with $1, $2... and
+// returns the names of the variables in the same order
+func bindVars(sql string) (string, []string) {
+	t := fasttemplate.New(sql, `('{{`, `}}')`)
+	am := make([]string, 0, 5)
+	i := 0
+
+	finalSQL := t.ExecuteFuncString(func(w io.Writer, tag string) (int, error) {
+		am = append(am, tag)
+		i++
+		return w.Write([]byte(fmt.Sprintf("$%d", i)))
+	})
+
+	return finalSQL, am
 }
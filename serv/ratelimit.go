@@ -0,0 +1,204 @@
+package serv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	roleAnon = "anon"
+	roleUser = "user"
+
+	maxRateBuckets = 100000
+)
+
+var (
+	errRateLimited = errors.New("too many requests")
+)
+
+// rateStore is implemented by the rate limiter backends. The in-memory
+// store works for a single instance, a shared store (eg. redis) is
+// needed to enforce limits across instances.
+type rateStore interface {
+	// take removes n tokens from the bucket if available and returns
+	// the tokens left or how long to wait till n tokens are available
+	take(key string, lim ConfigRateLimit, n float64) (int, time.Duration)
+
+	// charge removes n tokens from the bucket even if it goes negative
+	charge(key string, lim ConfigRateLimit, n float64)
+}
+
+type rateLimitInfo struct {
+	key string
+	lim ConfigRateLimit
+	rs  rateStore
+}
+
+// withRateLimit limits the requests using the rate_limit settings in
+// c, the buckets are kept across reloads
+func (sg *SuperGraph) withRateLimit(c *Config, next http.HandlerFunc) http.HandlerFunc {
+	if !c.RateLimit.Enable {
+		return next
+	}
+
+	rs := sg.rates
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, role := rateLimitKey(r, c)
+
+		lim, ok := c.RateLimit.Roles[role]
+		if !ok || lim.Rate <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		remaining, wait := rs.take(key, lim, 1)
+
+		h := w.Header()
+		h.Set("X-RateLimit-Limit", strconv.Itoa(lim.Burst))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+
+		if wait > 0 {
+			h.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			h.Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(gqlResp{Errors: []gqlError{newGQLError(errRateLimited)}})
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), rateLimitCtxKey,
+			&rateLimitInfo{key, lim, rs})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// rateLimitCharge charges the client extra tokens for expensive
+// queries once their cost is known
+func (c *coreContext) rateLimitCharge(qcost *queryCost) {
+	cu := c.conf.RateLimit.CostUnit
+	if cu <= 0 || qcost == nil {
+		return
+	}
+
+	ri, ok := c.Value(rateLimitCtxKey).(*rateLimitInfo)
+	if !ok {
+		return
+	}
+
+	if n := qcost.Cost / cu; n > 0 {
+		ri.rs.charge(ri.key, ri.lim, float64(n))
+	}
+}
+
+func rateLimitKey(r *http.Request, c *Config) (string, string) {
+	if v := r.Context().Value(userIDKey); v != nil {
+		return "user:" + v.(string), roleUser
+	}
+
+	rl := c.RateLimit
+	return "ip:" + clientIP(r, rl.IPHeader, rl.TrustedProxies), roleAnon
+}
+
+// clientIP returns the ip added to the header by the outermost of the
+// trusted proxies. Entries to the left of it are set by the client
+// and can't be trusted.
+func clientIP(r *http.Request, hn string, trusted int) string {
+	if len(hn) != 0 {
+		// X-Forwarded-For: client, proxy1, proxy2
+		if v := r.Header.Get(hn); len(v) != 0 {
+			ips := strings.Split(v, ",")
+
+			if trusted <= 0 {
+				trusted = 1
+			}
+
+			i := len(ips) - trusted
+			if i < 0 {
+				i = 0
+			}
+			return strings.TrimSpace(ips[i])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// in-memory token buckets
+
+type memRateStore struct {
+	sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newMemRateStore() *memRateStore {
+	return &memRateStore{buckets: make(map[string]*rateBucket)}
+}
+
+func (rs *memRateStore) take(key string, lim ConfigRateLimit, n float64) (int, time.Duration) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	b := rs.bucket(key, lim)
+
+	if b.tokens < n {
+		wait := (n - b.tokens) / lim.Rate
+		return 0, time.Duration(wait * float64(time.Second))
+	}
+	b.tokens -= n
+
+	return int(b.tokens), 0
+}
+
+func (rs *memRateStore) charge(key string, lim ConfigRateLimit, n float64) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.bucket(key, lim).tokens -= n
+}
+
+func (rs *memRateStore) bucket(key string, lim ConfigRateLimit) *rateBucket {
+	now := time.Now()
+	burst := float64(lim.Burst)
+
+	b, ok := rs.buckets[key]
+	if !ok {
+		if len(rs.buckets) >= maxRateBuckets {
+			rs.purge(now)
+		}
+		b = &rateBucket{tokens: burst, last: now}
+		rs.buckets[key] = b
+		return b
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*lim.Rate)
+	b.last = now
+
+	return b
+}
+
+// purge drops idle buckets, a bucket idle for this long is most
+// likely full again and a new bucket starts full
+func (rs *memRateStore) purge(now time.Time) {
+	for k, b := range rs.buckets {
+		if now.Sub(b.last) > time.Minute {
+			delete(rs.buckets, k)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package serv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitBucket(t *testing.T) {
+	rs := newMemRateStore()
+	lim := ConfigRateLimit{Rate: 10, Burst: 2}
+
+	if n, wait := rs.take("ip:1", lim, 1); wait != 0 || n != 1 {
+		t.Fatalf("Expecting 1 token remaining got %d (wait %s)", n, wait)
+	}
+
+	if n, wait := rs.take("ip:1", lim, 1); wait != 0 || n != 0 {
+		t.Fatalf("Expecting 0 tokens remaining got %d (wait %s)", n, wait)
+	}
+
+	if _, wait := rs.take("ip:1", lim, 1); wait == 0 {
+		t.Fatal("Expecting request to be rate limited")
+	}
+
+	// other clients have their own bucket
+	if _, wait := rs.take("ip:2", lim, 1); wait != 0 {
+		t.Fatal("Expecting request to not be rate limited")
+	}
+
+	time.Sleep(110 * time.Millisecond)
+
+	if _, wait := rs.take("ip:1", lim, 1); wait != 0 {
+		t.Fatal("Expecting bucket to have refilled")
+	}
+}
+
+func TestRateLimitCharge(t *testing.T) {
+	rs := newMemRateStore()
+	lim := ConfigRateLimit{Rate: 1, Burst: 5}
+
+	rs.take("user:1", lim, 1)
+	rs.charge("user:1", lim, 10)
+
+	_, wait := rs.take("user:1", lim, 1)
+	if wait < 5*time.Second {
+		t.Fatalf("Expecting a wait of over 5s got %s", wait)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/v1/graphql", nil)
+	r.RemoteAddr = "10.0.0.2:5000"
+
+	if ip := clientIP(r, "X-Forwarded-For", 1); ip != "10.0.0.2" {
+		t.Errorf("expecting the remote address got %s", ip)
+	}
+
+	// the left-most entry is set by the client
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7")
+
+	if ip := clientIP(r, "X-Forwarded-For", 0); ip != "203.0.113.7" {
+		t.Errorf("expecting the right-most ip got %s", ip)
+	}
+
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7, 10.0.0.1")
+
+	if ip := clientIP(r, "X-Forwarded-For", 2); ip != "203.0.113.7" {
+		t.Errorf("expecting the ip added by the outer proxy got %s", ip)
+	}
+
+	if ip := clientIP(r, "X-Forwarded-For", 5); ip != "1.2.3.4" {
+		t.Errorf("expecting the left-most ip got %s", ip)
+	}
+}
+
+func TestRateLimitReload(t *testing.T) {
+	c := &Config{}
+	c.RateLimit.Enable = true
+	c.RateLimit.Roles = map[string]ConfigRateLimit{roleAnon: {Rate: 0.1, Burst: 1}}
+
+	sg := &SuperGraph{log: testLog(), rates: newMemRateStore()}
+	next := func(w http.ResponseWriter, r *http.Request) {}
+
+	w := httptest.NewRecorder()
+	sg.withRateLimit(c, next)(w, httptest.NewRequest("POST", "/api/v1/graphql", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expecting a 200 got %d", w.Code)
+	}
+
+	// the handler built on reload uses the same buckets
+	w = httptest.NewRecorder()
+	sg.withRateLimit(c, next)(w, httptest.NewRequest("POST", "/api/v1/graphql", nil))
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expecting a 429 after the reload got %d", w.Code)
+	}
+}
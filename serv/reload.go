@@ -0,0 +1,313 @@
+package serv
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/dosco/super-graph/psql"
+	"github.com/dosco/super-graph/qcode"
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// wait for file changes to settle before reloading
+	reloadDelay = 500 * time.Millisecond
+)
+
+// snapshot is what a reload rebuilds, it's swapped in at once and
+// requests keep using the snapshot they started with
+type snapshot struct {
+	// the requests using it plus one while it's current, once it drops
+	// to zero the prepared statements are closed
+	refs int64
+
+	conf          *Config
+	qcompile      *qcode.Compiler
+	pcompile      *psql.Compiler
+	rmap          map[uint64]*resolvFn
+	allowList     *allowList
+	preparedList  map[string]*preparedItem
+	authFailBlock int
+
+	// the endpoints wrapped with the auth and rate limit middleware
+	apiHandler        http.HandlerFunc
+	apiExplainHandler http.HandlerFunc
+}
+
+// newSnapshot builds the compilers (reading the database schema),
+// resolvers, allow list and auth for the config
+func (sg *SuperGraph) newSnapshot(c *Config) (*snapshot, error) {
+	var err error
+
+	s := &snapshot{refs: 1, conf: c, authFailBlock: getAuthFailBlock(c)}
+
+	s.qcompile, s.pcompile, err = initCompilers(c, sg.db)
+	if err != nil {
+		return nil, err
+	}
+
+	s.rmap, err = initResolvers(c, s.pcompile, sg.log)
+	if err != nil {
+		return nil, err
+	}
+
+	s.apiHandler, err = withAuth(c, sg.sessions, sg.log, sg.withRateLimit(c,
+		func(w http.ResponseWriter, r *http.Request) { sg.apiv1Http(s, w, r) }))
+	if err != nil {
+		return nil, err
+	}
+
+	s.apiExplainHandler, err = withAuth(c, sg.sessions, sg.log,
+		func(w http.ResponseWriter, r *http.Request) { sg.explainHandler(s, w, r) })
+	if err != nil {
+		return nil, err
+	}
+
+	s.allowList, err = initAllowList(sg.confPath, c, sg.log)
+	if err != nil {
+		return nil, err
+	}
+
+	s.preparedList, err = initPreparedList(s.allowList, s.qcompile, s.pcompile)
+	if err != nil {
+		close(s.allowList.saveChan)
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// current returns the current snapshot, use acquire when it's used
+// for longer than reading the config
+func (sg *SuperGraph) current() *snapshot {
+	return sg.snap.Load().(*snapshot)
+}
+
+// acquire returns the current snapshot, release must be called once
+// the request is done with it
+func (sg *SuperGraph) acquire() *snapshot {
+	for {
+		if s := sg.current(); s.tryAcquire() {
+			return s
+		}
+	}
+}
+
+// tryAcquire fails once the snapshot is no longer current and the
+// requests using it are done
+func (s *snapshot) tryAcquire() bool {
+	for {
+		n := atomic.LoadInt64(&s.refs)
+		if n == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.refs, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (s *snapshot) release() {
+	if atomic.AddInt64(&s.refs, -1) == 0 {
+		close(s.allowList.saveChan)
+		closePreparedList(s.preparedList)
+	}
+}
+
+// withSnapshot serves the request with the handler from the current
+// snapshot, it's held till the request is done
+func (sg *SuperGraph) withSnapshot(h func(*snapshot) http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := sg.acquire()
+		defer s.release()
+
+		h(s)(w, r)
+	}
+}
+
+func (sg *SuperGraph) initReload() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		for range sighup {
+			sg.log.Info().Msg("SIGHUP received reloading")
+			sg.Reload()
+		}
+	}()
+
+	if err := sg.watchFiles(); err != nil {
+		sg.log.Warn().Err(err).Msg("failed to watch config files")
+	}
+}
+
+// Reload rebuilds the config, compilers (reading the database schema
+// again), resolvers, allow list and auth and swaps them in once they
+// are all built. On any error the current ones are kept. The config
+// is only read again when it was loaded from a config file.
+func (sg *SuperGraph) Reload() error {
+	sg.reloadMu.Lock()
+	defer sg.reloadMu.Unlock()
+
+	old := sg.current()
+	c := old.conf
+
+	if len(c.file) != 0 {
+		var err error
+
+		if c, err = initConf(sg.confPath); err != nil {
+			sg.log.Error().Err(err).Msg("reload: failed to read config")
+			return err
+		}
+	}
+
+	s, err := sg.newSnapshot(c)
+	if err != nil {
+		sg.log.Error().Err(err).Msg("reload failed")
+		return err
+	}
+
+	// the old prepared statements are closed once the requests
+	// still using them are done
+	sg.snap.Store(s)
+	old.release()
+
+	if sg.confLogs && len(c.file) != 0 {
+		setLogLevel(c)
+	}
+	sg.initPersistedQueries(s.allowList)
+
+	if sg.respCache != nil {
+		sg.respCache.reset()
+	}
+
+	sg.log.Info().Msg("reload complete")
+	return nil
+}
+
+// watchFiles reloads when the config file changes and in production
+// when the allow list changes. In development the allow list is
+// written to by super graph itself so it's not watched.
+func (sg *SuperGraph) watchFiles() error {
+	s := sg.current()
+	files := []string{s.conf.file}
+
+	if s.conf.UseAllowList {
+		files = append(files, s.allowList.filepath)
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// directories are watched since editors often replace files
+	// instead of writing to them
+	watched := make(map[string]struct{})
+
+	for i := range files {
+		if len(files[i]) == 0 {
+			continue
+		}
+
+		fp, err := filepath.Abs(files[i])
+		if err != nil {
+			return err
+		}
+		files[i] = fp
+
+		dir := filepath.Dir(fp)
+		if _, ok := watched[dir]; ok {
+			continue
+		}
+		watched[dir] = struct{}{}
+
+		if err := w.Add(dir); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		var timer *time.Timer
+
+		for {
+			select {
+			case ev := <-w.Events:
+				if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 ||
+					!matchFile(files, ev.Name) {
+					continue
+				}
+
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(reloadDelay, func() {
+					sg.log.Info().Msgf("%s changed reloading", ev.Name)
+					sg.Reload()
+				})
+
+			case err := <-w.Errors:
+				sg.log.Warn().Err(err).Msg("file watcher")
+			}
+		}
+	}()
+
+	return nil
+}
+
+func matchFile(files []string, name string) bool {
+	fp, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+
+	for i := range files {
+		if files[i] == fp {
+			return true
+		}
+	}
+	return false
+}
+
+func (sg *SuperGraph) adminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := sg.Reload(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(gqlResp{Errors: []gqlError{newGQLError(err)}})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// withAdminAuth only allows requests with the admin secret as
+// a bearer token
+func withAdminAuth(s string, next http.HandlerFunc) http.HandlerFunc {
+	secret := []byte(s)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ah := r.Header.Get("Authorization")
+		tok := []byte(strings.TrimPrefix(ah, "Bearer "))
+
+		if len(ah) == len(tok) || subtle.ConstantTimeCompare(tok, secret) != 1 {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,94 @@
+package serv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	h := withAdminAuth("secret", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		auth string
+		code int
+	}{
+		{"", 401},
+		{"secret", 401},
+		{"Bearer wrong", 401},
+		{"Bearer secret", 200},
+	}
+
+	for _, v := range tests {
+		r := httptest.NewRequest("POST", "/admin/reload", nil)
+		if len(v.auth) != 0 {
+			r.Header.Set("Authorization", v.auth)
+		}
+
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		if w.Code != v.code {
+			t.Errorf("Authorization '%s' expecting %d got %d", v.auth, v.code, w.Code)
+		}
+	}
+}
+
+func TestSnapshotSwap(t *testing.T) {
+	handler := func(v string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(v)) }
+	}
+
+	newSnapshot := func(v string) *snapshot {
+		return &snapshot{
+			refs:       1,
+			allowList:  &allowList{saveChan: make(chan *allowItem)},
+			apiHandler: handler(v),
+		}
+	}
+
+	closed := func(s *snapshot) bool {
+		select {
+		case <-s.allowList.saveChan:
+			return true
+		default:
+			return false
+		}
+	}
+
+	sg := &SuperGraph{log: testLog()}
+	s1 := newSnapshot("1")
+	sg.snap.Store(s1)
+
+	h := sg.withSnapshot(func(s *snapshot) http.HandlerFunc { return s.apiHandler })
+
+	// a request in flight during the reload
+	s := sg.acquire()
+
+	s2 := newSnapshot("2")
+	sg.snap.Store(s2)
+	s1.release()
+
+	if closed(s1) {
+		t.Fatal("expecting the old snapshot to be open while it's used")
+	}
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/api/v1/graphql", nil))
+
+	if w.Body.String() != "2" {
+		t.Errorf("expecting new requests to use the new snapshot got %s", w.Body.String())
+	}
+
+	s.release()
+
+	if !closed(s1) {
+		t.Error("expecting the old snapshot to be closed once it's not used")
+	}
+
+	if closed(s2) || sg.acquire() != s2 {
+		t.Error("expecting the new snapshot to be current")
+	}
+}
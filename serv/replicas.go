@@ -0,0 +1,232 @@
+package serv
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/rs/zerolog"
+)
+
+const (
+	readPrimaryHeader           = "X-Read-Primary"
+	replicaCheckTimeout         = 2 * time.Second
+	defaultReplicaCheckInterval = 5 * time.Second
+
+	// the lag is zero when the replica has replayed all the wal it
+	// received, otherwise it's the time since the last replayed
+	// transaction
+	replicaLagSQL = `SELECT CASE
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END`
+)
+
+// replicaSet sends read only queries to the healthy replicas, with a
+// nil replicaSet or no healthy replicas they go to the primary
+type replicaSet struct {
+	list      []*replica
+	leastConn bool
+	maxLag    time.Duration
+	next      uint32
+	stop      chan struct{}
+	log       *zerolog.Logger
+}
+
+type replica struct {
+	name string
+	db   *pg.DB
+
+	// set by the health checks
+	healthy int32
+	lag     int64
+
+	// queries running on the replica
+	active int32
+}
+
+func initReplicas(c *Config, log *zerolog.Logger) (*replicaSet, error) {
+	if len(c.DB.Replicas) == 0 {
+		return nil, nil
+	}
+
+	rs := &replicaSet{
+		maxLag: c.DB.ReplicaMaxLag,
+		stop:   make(chan struct{}),
+		log:    log,
+	}
+
+	switch c.DB.ReplicaPolicy {
+	case "", "round_robin":
+	case "least_conn":
+		rs.leastConn = true
+	default:
+		return nil, fmt.Errorf("unknown database.replica_policy '%s'", c.DB.ReplicaPolicy)
+	}
+
+	for _, v := range c.DB.Replicas {
+		opt := *dbOptions(c)
+
+		port := v.Port
+		if len(port) == 0 {
+			port = c.DB.Port
+		}
+		opt.Addr = strings.Join([]string{v.Host, port}, ":")
+
+		if len(v.User) != 0 {
+			opt.User = v.User
+			opt.Password = v.Password
+		}
+
+		if len(v.DBName) != 0 {
+			opt.Database = v.DBName
+		}
+
+		if v.PoolSize != 0 {
+			opt.PoolSize = v.PoolSize
+		}
+
+		// replicas are used once the first health check passes
+		rs.list = append(rs.list, &replica{name: opt.Addr, db: pg.Connect(&opt)})
+	}
+
+	interval := c.DB.ReplicaCheckInterval
+	if interval <= 0 {
+		interval = defaultReplicaCheckInterval
+	}
+
+	go rs.healthCheck(interval)
+
+	return rs, nil
+}
+
+// pick returns the replica to run a read only query on, or nil for
+// the primary. done must be called on the replica once the query
+// is complete.
+func (rs *replicaSet) pick() *replica {
+	if rs == nil {
+		return nil
+	}
+
+	var r *replica
+
+	if rs.leastConn {
+		for _, v := range rs.list {
+			if !v.ok(rs.maxLag) {
+				continue
+			}
+			if r == nil || atomic.LoadInt32(&v.active) < atomic.LoadInt32(&r.active) {
+				r = v
+			}
+		}
+
+	} else {
+		n := len(rs.list)
+		st := int(atomic.AddUint32(&rs.next, 1))
+
+		for i := 0; i < n; i++ {
+			if v := rs.list[(st+i)%n]; v.ok(rs.maxLag) {
+				r = v
+				break
+			}
+		}
+	}
+
+	if r != nil {
+		atomic.AddInt32(&r.active, 1)
+	}
+
+	return r
+}
+
+func (r *replica) done() {
+	if r != nil {
+		atomic.AddInt32(&r.active, -1)
+	}
+}
+
+// ok is false for replicas that failed the last health check or
+// are lagging more than database.replica_max_lag
+func (r *replica) ok(maxLag time.Duration) bool {
+	if atomic.LoadInt32(&r.healthy) == 0 {
+		return false
+	}
+	return maxLag == 0 || time.Duration(atomic.LoadInt64(&r.lag)) <= maxLag
+}
+
+func (rs *replicaSet) healthCheck(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		for _, r := range rs.list {
+			r.check(rs.maxLag, rs.log)
+		}
+
+		select {
+		case <-rs.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (r *replica) check(maxLag time.Duration, log *zerolog.Logger) {
+	var lag float64
+
+	_, err := r.db.WithTimeout(replicaCheckTimeout).QueryOne(pg.Scan(&lag), replicaLagSQL)
+	wasOk := r.ok(maxLag)
+
+	if err != nil {
+		atomic.StoreInt32(&r.healthy, 0)
+	} else {
+		atomic.StoreInt64(&r.lag, int64(lag*float64(time.Second)))
+		atomic.StoreInt32(&r.healthy, 1)
+	}
+
+	ok := r.ok(maxLag)
+
+	switch {
+	case ok && !wasOk:
+		log.Info().Str("replica", r.name).Msg("replica in use")
+	case !ok && wasOk:
+		log.Warn().Err(err).
+			Str("replica", r.name).
+			Dur("lag", time.Duration(atomic.LoadInt64(&r.lag))).
+			Msg("replica excluded")
+	case !ok && err != nil:
+		log.Debug().Err(err).Str("replica", r.name).Msg("replica health check failed")
+	}
+}
+
+func (rs *replicaSet) close() {
+	if rs == nil {
+		return
+	}
+	close(rs.stop)
+
+	for _, r := range rs.list {
+		if err := r.db.Close(); err != nil {
+			rs.log.Error().Err(err).Str("replica", r.name).Msg("replica closed")
+		}
+	}
+}
+
+// readReplica returns the replica to run the query on, nil when
+// it should run on the primary. Only queries are sent to replicas.
+func (c *coreContext) readReplica() *replica {
+	if !isQuery(c.req.Query) || c.Value(readPrimaryKey) != nil {
+		return nil
+	}
+	return c.replicas.pick()
+}
+
+// readPrimary is set by clients that need to read their own writes
+func readPrimary(r *http.Request) bool {
+	v, _ := strconv.ParseBool(r.Header.Get(readPrimaryHeader))
+	return v
+}
@@ -0,0 +1,113 @@
+package serv
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testReplicaSet(leastConn bool) *replicaSet {
+	rs := &replicaSet{leastConn: leastConn, maxLag: 10 * time.Second}
+
+	for _, v := range []string{"r1:5432", "r2:5432", "r3:5432"} {
+		rs.list = append(rs.list, &replica{name: v, healthy: 1})
+	}
+	return rs
+}
+
+func TestReplicaRoundRobin(t *testing.T) {
+	rs := testReplicaSet(false)
+
+	// unhealthy and lagging replicas are skipped
+	rs.list[1].healthy = 0
+	rs.list[2].lag = int64(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		r := rs.pick()
+		if r == nil || r.name != "r1:5432" {
+			t.Fatalf("expecting r1 got %v", r)
+		}
+		r.done()
+	}
+
+	rs.list[1].healthy = 1
+	seen := make(map[string]int)
+
+	for i := 0; i < 4; i++ {
+		r := rs.pick()
+		seen[r.name]++
+		r.done()
+	}
+
+	if seen["r1:5432"] != 2 || seen["r2:5432"] != 2 {
+		t.Errorf("expecting queries spread over r1 and r2 got %v", seen)
+	}
+
+	rs.list[0].healthy = 0
+	rs.list[1].healthy = 0
+
+	if r := rs.pick(); r != nil {
+		t.Errorf("expecting the primary to be used got %s", r.name)
+	}
+}
+
+func TestReplicaLeastConn(t *testing.T) {
+	rs := testReplicaSet(true)
+
+	r1 := rs.pick()
+	r2 := rs.pick()
+	r3 := rs.pick()
+
+	if r1 == r2 || r2 == r3 || r1 == r3 {
+		t.Fatal("expecting each query to go to a different replica")
+	}
+
+	r2.done()
+
+	if r := rs.pick(); r != r2 {
+		t.Errorf("expecting the replica with the fewest queries got %s", r.name)
+	}
+}
+
+func TestReadPrimary(t *testing.T) {
+	c := &coreContext{
+		Context:    context.Background(),
+		SuperGraph: &SuperGraph{log: testLog(), replicas: testReplicaSet(false)},
+	}
+
+	if c.readReplica() == nil {
+		t.Error("expecting a replica")
+	}
+
+	c.req.Query = `mutation { products(insert: $data) { id } }`
+
+	if c.readReplica() != nil {
+		t.Error("expecting mutations to use the primary")
+	}
+
+	c.req.Query = `query getProducts { products { id } }`
+
+	if c.readReplica() == nil {
+		t.Error("expecting a replica for a named query")
+	}
+
+	c.Context = WithReadPrimary(c.Context)
+
+	if c.readReplica() != nil {
+		t.Error("expecting the primary to be used")
+	}
+
+	c = &coreContext{Context: context.Background(), SuperGraph: &SuperGraph{log: testLog()}}
+
+	if c.readReplica() != nil {
+		t.Error("expecting the primary to be used without replicas")
+	}
+
+	r := httptest.NewRequest("POST", "/api/v1/graphql", nil)
+	r.Header.Set(readPrimaryHeader, "true")
+
+	if !readPrimary(r) {
+		t.Errorf("expecting %s to be read", readPrimaryHeader)
+	}
+}
@@ -1,40 +1,51 @@
 package serv
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
+	"net/url"
 	"strings"
 
 	"github.com/cespare/xxhash/v2"
-	"github.com/dosco/super-graph/jsn"
 	"github.com/dosco/super-graph/psql"
-)
-
-var (
-	rmap map[uint64]*resolvFn
+	"github.com/rs/zerolog"
 )
 
 type resolvFn struct {
-	IDField []byte
-	Path    [][]byte
-	Fn      func(r *http.Request, id []byte) ([]byte, error)
+	Name     string
+	IDCol    string
+	Path     [][]byte
+	Required bool
+	Fn       func(rr *remoteReq) ([]byte, error)
+	Batch    *batchFn
+	GraphQL  graphqlFn
+}
+
+// remoteReq is what a request to a remote can use, the id and other
+// columns from the parent row and the user from the context
+type remoteReq struct {
+	ctx   context.Context
+	inReq *http.Request // nil when used as a library
+	id    []byte
+	cols  map[string][]byte
 }
 
-func initResolvers() error {
-	rmap = make(map[uint64]*resolvFn)
+func initResolvers(c *Config, pc *psql.Compiler, log *zerolog.Logger) (map[uint64]*resolvFn, error) {
+	rm := make(map[uint64]*resolvFn)
 
-	for _, t := range conf.DB.Tables {
-		err := initRemotes(t)
+	for _, t := range c.DB.Tables {
+		err := initRemotes(t, pc, rm, log)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	return rm, nil
 }
 
-func initRemotes(t configTable) error {
+func initRemotes(t ConfigTable, pc *psql.Compiler, rm map[uint64]*resolvFn,
+	log *zerolog.Logger) error {
 	h := xxhash.New()
 	var err error
 
@@ -46,7 +57,7 @@ func initRemotes(t configTable) error {
 		// if no table column specified in the config then
 		// use the primary key of the table as the id
 		if len(idcol) == 0 {
-			idcol, err = pcompile.IDColumn(t.Name)
+			idcol, err = pc.IDColumn(t.Name)
 			if err != nil {
 				return err
 			}
@@ -60,16 +71,30 @@ func initRemotes(t configTable) error {
 			Type: psql.RelRemote,
 			Col1: idcol,
 			Col2: idk,
+			Cols: r.Columns,
 		}
 
-		err := pcompile.AddRelationship(strings.ToLower(r.Name), t.Name, val)
+		err := pc.AddRelationship(strings.ToLower(r.Name), t.Name, val)
 		if err != nil {
 			return err
 		}
 
+		if err := checkRemoteCols(r); err != nil {
+			return err
+		}
+
+		if err := checkRemoteVars(r); err != nil {
+			return err
+		}
+
 		// the function thats called to resolve this remote
 		// data request
-		fn := buildFn(r)
+		rc := newRemoteClient(r, log)
+
+		fn, err := buildFn(r, rc)
+		if err != nil {
+			return err
+		}
 
 		path := [][]byte{}
 		for _, p := range strings.Split(r.Path, ".") {
@@ -77,82 +102,213 @@ func initRemotes(t configTable) error {
 		}
 
 		rf := &resolvFn{
-			IDField: []byte(idk),
-			Path:    path,
-			Fn:      fn,
+			Name:     r.Name,
+			IDCol:    idcol,
+			Path:     path,
+			Required: r.Required,
+			Fn:       fn,
 		}
 
-		// index resolver obj by parent and child names
-		rmap[mkkey(h, r.Name, t.Name)] = rf
+		switch r.Type {
+		case "", "rest":
+		case "graphql":
+			if rf.GraphQL, err = buildGraphQLFn(r, rc); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("remote %s: unknown type %s", r.Name, r.Type)
+		}
 
-		// index resolver obj by IDField
-		rmap[xxhash.Sum64(rf.IDField)] = rf
+		if len(r.BatchURL) != 0 && rf.GraphQL == nil {
+			if rf.Batch, err = buildBatchFn(r, rc); err != nil {
+				return err
+			}
+		}
+
+		// index resolver obj by parent and child names
+		rm[mkkey(h, r.Name, t.Name)] = rf
 	}
 
 	return nil
 }
 
-func buildFn(r configRemote) func(*http.Request, []byte) ([]byte, error) {
-	reqURL := strings.Replace(r.URL, "$id", "%s", 1)
-	client := &http.Client{}
+func buildFn(r ConfigRemote, rc *remoteClient) (func(*remoteReq) ([]byte, error), error) {
+	method := strings.ToUpper(r.Method)
 
-	fn := func(inReq *http.Request, id []byte) ([]byte, error) {
-		uri := fmt.Sprintf(reqURL, id)
-		req, err := http.NewRequest("GET", uri, nil)
+	switch method {
+	case "", "GET":
+		method = "GET"
+		if len(r.Body) != 0 {
+			return nil, fmt.Errorf("remote %s: body needs a post", r.Name)
+		}
+	case "POST":
+	default:
+		return nil, fmt.Errorf("remote %s: unsupported method %s", r.Name, r.Method)
+	}
+
+	fn := func(rr *remoteReq) ([]byte, error) {
+		uri, err := expandVars(r.URL, rr, url.PathEscape)
 		if err != nil {
 			return nil, err
 		}
 
-		for _, v := range r.SetHeaders {
-			req.Header.Set(v.Name, v.Value)
-		}
+		var body []byte
 
-		for _, v := range r.PassHeaders {
-			req.Header.Set(v, inReq.Header.Get(v))
+		if len(r.Body) != 0 {
+			v, err := expandVars(r.Body, rr, jsonEscape)
+			if err != nil {
+				return nil, err
+			}
+			body = []byte(v)
 		}
 
-		if host, ok := req.Header["Host"]; ok {
-			req.Host = host[0]
-		}
+		return rc.do(rr, method, uri, body)
+	}
 
-		res, err := client.Do(req)
-		if err != nil {
-			logger.Error().Err(err).Msgf("Failed to connect to: %s", uri)
-			return nil, err
-		}
-		defer res.Body.Close()
+	return fn, nil
+}
 
-		if r.Debug {
-			reqDump, err := httputil.DumpRequestOut(req, true)
-			if err != nil {
-				return nil, err
+// lookup returns the value of a variable used in the url, body or
+// headers of a remote
+func (rr *remoteReq) lookup(name string) ([]byte, error) {
+	switch name {
+	case "id":
+		return rr.id, nil
+
+	case "user_id", "USER_ID":
+		if rr.ctx != nil {
+			if v := rr.ctx.Value(userIDKey); v != nil {
+				return []byte(v.(string)), nil
 			}
+		}
+		return nil, errNoUserID
 
-			resDump, err := httputil.DumpResponse(res, true)
-			if err != nil {
-				return nil, err
+	case "user_id_provider", "USER_ID_PROVIDER":
+		if rr.ctx != nil {
+			if v := rr.ctx.Value(userIDProviderKey); v != nil {
+				return []byte(v.(string)), nil
 			}
+		}
+		return nil, errNoUserID
+	}
+
+	if v, ok := rr.cols[name]; ok {
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("unknown variable $%s", name)
+}
+
+// expandVars replaces the $variables in s with their values, esc
+// escapes the values for where they are used
+func expandVars(s string, rr *remoteReq, esc func(string) string) (string, error) {
+	if strings.IndexByte(s, '$') == -1 {
+		return s, nil
+	}
+
+	var sb strings.Builder
 
-			logger.Warn().Msgf("Remote Request Debug:\n%s\n%s",
-				reqDump, resDump)
+	for {
+		i := strings.IndexByte(s, '$')
+		if i == -1 {
+			break
 		}
+		sb.WriteString(s[:i])
+		s = s[i+1:]
 
-		if res.StatusCode != 200 {
-			return nil,
-				fmt.Errorf("server responded with a %d", res.StatusCode)
+		n := varNameLen(s)
+		if n == 0 {
+			sb.WriteByte('$')
+			continue
 		}
 
-		b, err := ioutil.ReadAll(res.Body)
+		v, err := rr.lookup(s[:n])
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 
-		if err := jsn.ValidateBytes(b); err != nil {
-			return nil, err
+		if esc != nil {
+			sb.WriteString(esc(string(v)))
+		} else {
+			sb.Write(v)
+		}
+		s = s[n:]
+	}
+	sb.WriteString(s)
+
+	return sb.String(), nil
+}
+
+// checkRemoteCols rejects columns on remotes that are only sent the
+// id, batches are keyed by the id and graphql remotes get it as the
+// only query variable
+func checkRemoteCols(r ConfigRemote) error {
+	if len(r.Columns) == 0 {
+		return nil
+	}
+
+	if len(r.BatchURL) != 0 {
+		return fmt.Errorf("remote %s: columns can't be used with batch_url", r.Name)
+	}
+
+	if r.Type == "graphql" {
+		return fmt.Errorf("remote %s: columns can't be used with type graphql", r.Name)
+	}
+
+	return nil
+}
+
+// checkRemoteVars makes sure the variables used by a remote are either
+// it's columns or the user variables
+func checkRemoteVars(r ConfigRemote) error {
+	known := map[string]struct{}{
+		"id":               {},
+		"user_id":          {},
+		"user_id_provider": {},
+		"USER_ID":          {},
+		"USER_ID_PROVIDER": {},
+	}
+
+	for _, c := range r.Columns {
+		known[c] = struct{}{}
+	}
+
+	tmpls := []string{r.URL, r.Body}
+	for _, v := range r.SetHeaders {
+		tmpls = append(tmpls, v.Value)
+	}
+
+	for _, s := range tmpls {
+		for {
+			i := strings.IndexByte(s, '$')
+			if i == -1 {
+				break
+			}
+			s = s[i+1:]
+			n := varNameLen(s)
+
+			if _, ok := known[s[:n]]; n != 0 && !ok {
+				return fmt.Errorf("remote %s: unknown variable $%s", r.Name, s[:n])
+			}
+			s = s[n:]
 		}
+	}
 
-		return b, nil
+	return nil
+}
+
+func varNameLen(s string) int {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return i
+		}
 	}
+	return len(s)
+}
 
-	return fn
+// jsonEscape escapes a value used within a json string
+func jsonEscape(v string) string {
+	b, _ := json.Marshal(v)
+	return string(b[1 : len(b)-1])
 }
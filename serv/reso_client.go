@@ -0,0 +1,377 @@
+package serv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dosco/super-graph/jsn"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultRemoteTimeout  = 10 * time.Second
+	defaultRetryBackoff   = 100 * time.Millisecond
+	defaultBreakerTimeout = 30 * time.Second
+	maxRemoteCacheEntries = 10000
+)
+
+var (
+	errBreakerOpen = errors.New("circuit breaker open")
+)
+
+// statusError is returned when a remote responds with a status
+// other than 200
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("server responded with a %d", int(e))
+}
+
+// remoteClient sends the requests for a remote, it's shared by all
+// the ways a remote can be fetched
+type remoteClient struct {
+	conf    ConfigRemote
+	client  *http.Client
+	backoff time.Duration
+	breaker *breaker
+	cache   *lruCache
+	log     *zerolog.Logger
+}
+
+func newRemoteClient(r ConfigRemote, log *zerolog.Logger) *remoteClient {
+	rc := &remoteClient{
+		conf:    r,
+		client:  &http.Client{Timeout: r.Timeout},
+		backoff: r.RetryBackoff,
+		log:     log,
+	}
+
+	if rc.client.Timeout <= 0 {
+		rc.client.Timeout = defaultRemoteTimeout
+	}
+
+	if rc.backoff <= 0 {
+		rc.backoff = defaultRetryBackoff
+	}
+
+	if r.BreakerThreshold > 0 {
+		rc.breaker = &breaker{threshold: r.BreakerThreshold, timeout: r.BreakerTimeout}
+
+		if rc.breaker.timeout <= 0 {
+			rc.breaker.timeout = defaultBreakerTimeout
+		}
+	}
+
+	if r.CacheTTL > 0 {
+		rc.cache = newLRUCache(maxRemoteCacheEntries)
+	}
+
+	return rc
+}
+
+// do sends the request and returns the validated json response. GET
+// requests are retried on connection errors and 5xx or 429 responses.
+func (rc *remoteClient) do(rr *remoteReq, method, uri string, body []byte) ([]byte, error) {
+	var key string
+
+	// header values can use variables
+	hdrs := make([]string, len(rc.conf.SetHeaders))
+
+	for i, v := range rc.conf.SetHeaders {
+		var err error
+
+		if hdrs[i], err = expandVars(v.Value, rr, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if rc.cache != nil {
+		key = rc.cacheKey(rr, method, uri, body, hdrs)
+
+		if b, ok := rc.cache.get(key); ok {
+			return b, nil
+		}
+	}
+
+	if rc.breaker != nil {
+		ok, trial := rc.breaker.allow()
+		if !ok {
+			return nil, errBreakerOpen
+		}
+		// a canceled trial request must not keep the breaker open
+		if trial {
+			defer rc.breaker.release()
+		}
+	}
+
+	retries := 0
+	if method == "GET" {
+		retries = rc.conf.Retries
+	}
+
+	var b []byte
+	var err error
+
+	for i := 0; ; i++ {
+		if b, err = rc.send(rr, method, uri, body, hdrs); err == nil || !retryable(err) {
+			break
+		}
+
+		if i == retries || !rc.sleep(rr, rc.backoff<<uint(i)) {
+			break
+		}
+	}
+
+	// responses like a 404 can mean there is no data
+	if e, ok := err.(statusError); ok && rc.nullStatus(int(e)) {
+		b, err = []byte("null"), nil
+	}
+
+	// only failures of the remote count towards opening the breaker
+	if rc.breaker != nil && !canceled(rr) {
+		if err != nil && retryable(err) {
+			rc.breaker.failure()
+		} else {
+			rc.breaker.success()
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if rc.cache != nil {
+		rc.cache.set(key, b, nil, rc.conf.CacheTTL)
+	}
+
+	return b, nil
+}
+
+func (rc *remoteClient) send(rr *remoteReq, method, uri string, body []byte,
+	hdrs []string) ([]byte, error) {
+	var rb io.Reader
+	if body != nil {
+		rb = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, uri, rb)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	r := rc.conf
+
+	for i, v := range r.SetHeaders {
+		req.Header.Set(v.Name, hdrs[i])
+	}
+
+	// no incoming request when used as a library
+	if rr.inReq != nil {
+		for _, v := range r.PassHeaders {
+			req.Header.Set(v, rr.inReq.Header.Get(v))
+		}
+	}
+
+	// stop when the client goes away
+	if rr.ctx != nil {
+		req = req.WithContext(rr.ctx)
+	}
+
+	sp := rc.startSpan(rr, req)
+	defer sp.finish()
+
+	if host, ok := req.Header["Host"]; ok {
+		req.Host = host[0]
+	}
+
+	res, err := rc.client.Do(req)
+	if err != nil {
+		sp.setError(err)
+		rc.log.Error().Err(err).Msgf("Failed to connect to: %s", uri)
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	sp.setAttr("http.status_code", strconv.Itoa(res.StatusCode))
+
+	if r.Debug {
+		reqDump, err := httputil.DumpRequestOut(req, true)
+		if err != nil {
+			return nil, err
+		}
+
+		resDump, err := httputil.DumpResponse(res, true)
+		if err != nil {
+			return nil, err
+		}
+
+		rc.log.Warn().Msgf("Remote Request Debug:\n%s\n%s",
+			reqDump, resDump)
+	}
+
+	if res.StatusCode != 200 {
+		sp.setError(statusError(res.StatusCode))
+		return nil, statusError(res.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := jsn.ValidateBytes(b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// startSpan starts a span for a call to the remote and adds the
+// traceparent header so the remote can continue the trace
+func (rc *remoteClient) startSpan(rr *remoteReq, req *http.Request) *span {
+	_, sp := startSpan(rr.ctx, "remote "+rc.conf.Name)
+	if sp == nil {
+		return nil
+	}
+	sp.kind = spanClient
+
+	sp.setAttr("http.method", req.Method)
+	sp.setAttr("http.url", req.URL.String())
+	req.Header.Set(traceparentHeader, sp.traceparent())
+
+	return sp
+}
+
+// cacheKey is the hash of the request including the value of the
+// headers so responses for one user are not used for another
+func (rc *remoteClient) cacheKey(rr *remoteReq, method, uri string, body []byte,
+	hdrs []string) string {
+	h := xxhash.New()
+
+	h.WriteString(method)
+	h.WriteString(uri)
+	h.Write(body)
+
+	for _, v := range hdrs {
+		h.WriteString(v)
+	}
+
+	if rr.inReq != nil {
+		for _, v := range rc.conf.PassHeaders {
+			h.WriteString(rr.inReq.Header.Get(v))
+		}
+	}
+
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+func (rc *remoteClient) nullStatus(code int) bool {
+	for _, v := range rc.conf.NullStatus {
+		if v == code {
+			return true
+		}
+	}
+	return false
+}
+
+// sleep waits for the backoff and returns false if the request is
+// canceled first
+func (rc *remoteClient) sleep(rr *remoteReq, d time.Duration) bool {
+	if rr.ctx == nil {
+		time.Sleep(d)
+		return true
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-rr.ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func canceled(rr *remoteReq) bool {
+	return rr.ctx != nil && rr.ctx.Err() != nil
+}
+
+func retryable(err error) bool {
+	if e, ok := err.(statusError); ok {
+		return e >= 500 || e == http.StatusTooManyRequests
+	}
+
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// breaker stops calling a remote after threshold failures in a row,
+// after the timeout a single request is let through to check if the
+// remote is back
+type breaker struct {
+	sync.Mutex
+	threshold int
+	timeout   time.Duration
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// allow returns if the request can be sent and if it's the trial
+// request, release must be called once the trial is done
+func (b *breaker) allow() (bool, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.failures < b.threshold {
+		return true, false
+	}
+
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false, false
+	}
+
+	b.trial = true
+	return true, true
+}
+
+func (b *breaker) success() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures = 0
+}
+
+// release ends the trial request whatever the outcome
+func (b *breaker) release() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.trial = false
+}
+
+func (b *breaker) failure() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures++
+
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.timeout)
+	}
+}
@@ -0,0 +1,173 @@
+package serv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func remoteTestServer(fail int32, delay time.Duration) (*httptest.Server, *int32) {
+	if logger == nil {
+		logger = initLog()
+	}
+	var calls int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		time.Sleep(delay)
+
+		if n <= fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"amount": 10}`))
+	}))
+
+	return ts, &calls
+}
+
+func TestRemoteTimeout(t *testing.T) {
+	ts, _ := remoteTestServer(0, 200*time.Millisecond)
+	defer ts.Close()
+
+	rc := newRemoteClient(ConfigRemote{Timeout: 20 * time.Millisecond}, testLog())
+
+	if _, err := rc.do(&remoteReq{}, "GET", ts.URL, nil); err == nil {
+		t.Fatal("expecting a timeout error")
+	}
+}
+
+func TestRemoteRetry(t *testing.T) {
+	ts, calls := remoteTestServer(2, 0)
+	defer ts.Close()
+
+	rc := newRemoteClient(ConfigRemote{Retries: 2, RetryBackoff: time.Millisecond}, testLog())
+
+	b, err := rc.do(&remoteReq{}, "GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != `{"amount": 10}` || *calls != 3 {
+		t.Errorf("expecting a response after 3 calls got %s after %d", b, *calls)
+	}
+
+	// posts are not retried
+	ts, calls = remoteTestServer(1, 0)
+	defer ts.Close()
+
+	if _, err := rc.do(&remoteReq{}, "POST", ts.URL, []byte(`{}`)); err == nil || *calls != 1 {
+		t.Errorf("expecting a single failed call got %d", *calls)
+	}
+}
+
+func TestRemoteBreaker(t *testing.T) {
+	ts, calls := remoteTestServer(3, 0)
+	defer ts.Close()
+
+	rc := newRemoteClient(ConfigRemote{
+		BreakerThreshold: 3,
+		BreakerTimeout:   50 * time.Millisecond,
+	}, testLog())
+
+	for i := 0; i < 3; i++ {
+		if _, err := rc.do(&remoteReq{}, "GET", ts.URL, nil); err == nil {
+			t.Fatal("expecting an error")
+		}
+	}
+
+	if _, err := rc.do(&remoteReq{}, "GET", ts.URL, nil); err != errBreakerOpen {
+		t.Fatalf("expecting the breaker to be open got %v", err)
+	}
+
+	if *calls != 3 {
+		t.Errorf("expecting 3 calls got %d", *calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	// a trial request is let through and closes the breaker
+	if _, err := rc.do(&remoteReq{}, "GET", ts.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rc.do(&remoteReq{}, "GET", ts.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteBreakerCanceledTrial(t *testing.T) {
+	ts, calls := remoteTestServer(3, 0)
+	defer ts.Close()
+
+	rc := newRemoteClient(ConfigRemote{
+		BreakerThreshold: 3,
+		BreakerTimeout:   20 * time.Millisecond,
+	}, testLog())
+
+	for i := 0; i < 3; i++ {
+		rc.do(&remoteReq{}, "GET", ts.URL, nil)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	// the trial request is canceled before it's sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := rc.do(&remoteReq{ctx: ctx}, "GET", ts.URL, nil); err == nil {
+		t.Fatal("expecting an error")
+	}
+
+	if _, err := rc.do(&remoteReq{}, "GET", ts.URL, nil); err != nil {
+		t.Fatalf("expecting a new trial request got %v", err)
+	}
+
+	if *calls != 4 {
+		t.Errorf("expecting 4 calls got %d", *calls)
+	}
+}
+
+func TestRemoteRetryCanceled(t *testing.T) {
+	ts, calls := remoteTestServer(10, 0)
+	defer ts.Close()
+
+	rc := newRemoteClient(ConfigRemote{Retries: 5, RetryBackoff: time.Second}, testLog())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	st := time.Now()
+
+	if _, err := rc.do(&remoteReq{ctx: ctx}, "GET", ts.URL, nil); err == nil {
+		t.Fatal("expecting an error")
+	}
+
+	if d := time.Since(st); d > 500*time.Millisecond || *calls != 1 {
+		t.Errorf("expecting the backoff to stop on cancel, took %s for %d calls", d, *calls)
+	}
+}
+
+func TestRemoteCache(t *testing.T) {
+	ts, calls := remoteTestServer(0, 0)
+	defer ts.Close()
+
+	rc := newRemoteClient(ConfigRemote{CacheTTL: time.Minute}, testLog())
+
+	for i := 0; i < 3; i++ {
+		if _, err := rc.do(&remoteReq{}, "GET", ts.URL+"/1", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := rc.do(&remoteReq{}, "GET", ts.URL+"/2", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if *calls != 2 {
+		t.Errorf("expecting 2 calls got %d", *calls)
+	}
+}
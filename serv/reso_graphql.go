@@ -0,0 +1,117 @@
+package serv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dosco/super-graph/qcode"
+)
+
+// graphqlFn fetches the remote data from a graphql service, the
+// sub-selection of the remote field is sent as the query
+type graphqlFn func(rr *remoteReq, sel []qcode.Select, s *qcode.Select) ([]byte, error)
+
+func buildGraphQLFn(r ConfigRemote, rc *remoteClient) (graphqlFn, error) {
+	if len(r.BatchURL) != 0 {
+		return nil, fmt.Errorf("remote %s: batch_url is not supported with graphql", r.Name)
+	}
+
+	field := r.Field
+	if len(field) == 0 {
+		field = r.Name
+	}
+
+	idArg := r.IDArg
+	if len(idArg) == 0 {
+		idArg = "id"
+	}
+
+	idType := r.IDType
+	if len(idType) == 0 {
+		idType = "ID!"
+	}
+
+	// numbers are sent as is and everything else as a string
+	idNum := strings.HasPrefix(idType, "Int") || strings.HasPrefix(idType, "Float")
+
+	fn := func(rr *remoteReq, sel []qcode.Select, s *qcode.Select) ([]byte, error) {
+
+		var q bytes.Buffer
+
+		fmt.Fprintf(&q, "query ($id: %s) { %s(%s: $id) ", idType, field, idArg)
+		graphqlSelection(&q, sel, s)
+		q.WriteString(" }")
+
+		var v interface{} = string(rr.id)
+		if idNum {
+			v = json.RawMessage(rr.id)
+		}
+
+		body, err := json.Marshal(map[string]interface{}{
+			"query":     q.String(),
+			"variables": map[string]interface{}{"id": v},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := rc.do(rr, "POST", r.URL, body)
+		if err != nil {
+			return nil, err
+		}
+
+		var res struct {
+			Data   map[string]json.RawMessage
+			Errors []gqlError
+		}
+
+		if err := json.Unmarshal(b, &res); err != nil {
+			return nil, err
+		}
+
+		if len(res.Errors) != 0 {
+			return nil, errors.New(gqlErrors(res.Errors).Error())
+		}
+
+		if d, ok := res.Data[field]; ok {
+			return d, nil
+		}
+
+		return []byte("null"), nil
+	}
+
+	return fn, nil
+}
+
+// graphqlSelection writes the fields and nested selections of
+// the select, aliases are kept so the response can be used as is
+func graphqlSelection(w *bytes.Buffer, sel []qcode.Select, s *qcode.Select) {
+	w.WriteString("{")
+
+	for _, col := range s.Cols {
+		w.WriteString(" ")
+		if col.FieldName != col.Name {
+			w.WriteString(col.FieldName)
+			w.WriteString(": ")
+		}
+		w.WriteString(col.Name)
+	}
+
+	for _, id := range s.Children {
+		child := &sel[id]
+
+		w.WriteString(" ")
+		if child.FieldName != child.Table {
+			w.WriteString(child.FieldName)
+			w.WriteString(": ")
+		}
+		w.WriteString(child.Table)
+		w.WriteString(" ")
+		graphqlSelection(w, sel, child)
+	}
+
+	w.WriteString(" }")
+}
@@ -0,0 +1,97 @@
+package serv
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dosco/super-graph/jsn"
+	"github.com/dosco/super-graph/qcode"
+)
+
+func TestGraphQLSelection(t *testing.T) {
+	sel := []qcode.Select{
+		{ID: 0, Table: "profile", FieldName: "profile", Children: []int32{1},
+			Cols: []qcode.Column{{Name: "id", FieldName: "id"}, {Name: "name", FieldName: "fullName"}}},
+		{ID: 1, ParentID: 0, Table: "address", FieldName: "home",
+			Cols: []qcode.Column{{Name: "city", FieldName: "city"}}},
+	}
+
+	var w bytes.Buffer
+	graphqlSelection(&w, sel, &sel[0])
+
+	exp := `{ id fullName: name home: address { city } }`
+	if w.String() != exp {
+		t.Errorf("expecting %s got %s", exp, w.String())
+	}
+}
+
+func TestGraphQLRemote(t *testing.T) {
+	var gotQuery string
+	var gotVars map[string]interface{}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query     string
+			Variables map[string]interface{}
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		gotQuery, gotVars = req.Query, req.Variables
+
+		if req.Variables["id"] == "2" {
+			w.Write([]byte(`{"data": {"billing": null}, "errors": [{"message": "not found"}]}`))
+			return
+		}
+		w.Write([]byte(`{"data": {"billing": {"amount": 10}}}`))
+	}))
+	defer ts.Close()
+
+	conf := ConfigRemote{
+		Name:  "payments",
+		URL:   ts.URL,
+		Field: "billing",
+	}
+
+	fn, err := buildGraphQLFn(conf, newRemoteClient(conf, testLog()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, sel, rsmap := remoteTestContext(false)
+	c.rmap[mkkey(xxhash.New(), "payments", "users")].GraphQL = fn
+
+	data := []byte(`[{"__users_id_1": 1}, {"__users_id_1": 2}]`)
+	from := jsn.Get(data, [][]byte{[]byte("__users_id_1")})
+
+	to, err := c.resolveRemotes(nil, from, sel, rsmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ob bytes.Buffer
+
+	if err := jsn.Replace(&ob, data, from, to); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := `[{"payments":{"amount": 10}}, {"payments":null}]`
+	if ob.String() != exp {
+		t.Errorf("expecting %s got %s", exp, ob.String())
+	}
+
+	if len(c.res.Errors) != 1 || c.res.Errors[0].Message != "payments: not found" {
+		t.Errorf("unexpected errors %v", c.res.Errors)
+	}
+
+	expQuery := `query ($id: ID!) { billing(id: $id) { amount } }`
+	if gotQuery != expQuery {
+		t.Errorf("expecting query %s got %s", expQuery, gotQuery)
+	}
+
+	if _, ok := gotVars["id"].(string); !ok {
+		t.Errorf("expecting a string id got %v", gotVars["id"])
+	}
+}
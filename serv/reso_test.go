@@ -0,0 +1,145 @@
+package serv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestExpandVars(t *testing.T) {
+	ctx := context.WithValue(context.Background(), userIDKey, "5")
+
+	rr := &remoteReq{
+		ctx:  ctx,
+		id:   []byte("a/1"),
+		cols: map[string][]byte{"region": []byte(`eu "west"`)},
+	}
+
+	v, err := expandVars("http://api/$id/invoices?user=$user_id&x=$", rr, url.PathEscape)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := "http://api/a%2F1/invoices?user=5&x=$"; v != exp {
+		t.Errorf("expecting %s got %s", exp, v)
+	}
+
+	v, err = expandVars(`{"region": "$region"}`, rr, jsonEscape)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := `{"region": "eu \"west\""}`; v != exp {
+		t.Errorf("expecting %s got %s", exp, v)
+	}
+
+	rr.ctx = context.Background()
+
+	if _, err := expandVars("$user_id", rr, nil); err != errNoUserID {
+		t.Errorf("expecting errNoUserID got %v", err)
+	}
+}
+
+func TestCheckRemoteVars(t *testing.T) {
+	r := ConfigRemote{
+		Name:    "invoices",
+		Columns: []string{"region"},
+		URL:     "http://api/$id?region=$region",
+		Body:    `{"user": "$user_id"}`,
+	}
+
+	if err := checkRemoteVars(r); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Body = `{"account": "$account_id"}`
+
+	if err := checkRemoteVars(r); err == nil {
+		t.Fatal("expecting an error for an unknown variable")
+	}
+}
+
+func TestCheckRemoteCols(t *testing.T) {
+	r := ConfigRemote{Name: "invoices", Columns: []string{"region"}}
+
+	if err := checkRemoteCols(r); err != nil {
+		t.Fatal(err)
+	}
+
+	r.BatchURL = "http://api/batch?ids=$ids"
+
+	if err := checkRemoteCols(r); err == nil {
+		t.Error("expecting an error for columns with a batch_url")
+	}
+
+	r.BatchURL, r.Type = "", "graphql"
+
+	if err := checkRemoteCols(r); err == nil {
+		t.Error("expecting an error for columns with a graphql remote")
+	}
+}
+
+func TestRemotePost(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+
+		if r.Method != "POST" || r.Header.Get("X-User") != "5" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if body["account"] == "2" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer ts.Close()
+
+	conf := ConfigRemote{
+		Name:       "invoices",
+		Columns:    []string{"region"},
+		Method:     "post",
+		URL:        ts.URL,
+		Body:       `{"account": "$id", "region": "$region"}`,
+		NullStatus: []int{404},
+	}
+	conf.SetHeaders = append(conf.SetHeaders, struct {
+		Name  string
+		Value string
+	}{"X-User", "$user_id"})
+
+	fn, err := buildFn(conf, newRemoteClient(conf, testLog()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), userIDKey, "5")
+	c := &coreContext{Context: ctx}
+	r := &resolvFn{IDCol: "account_id"}
+
+	rr := c.newRemoteReq(nil, r, []byte(`{"account_id": 1, "region": "eu"}`))
+
+	b, err := fn(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := `{"account":"1","region":"eu"}`; string(b) != exp+"\n" {
+		t.Errorf("expecting %s got %s", exp, b)
+	}
+
+	rr = c.newRemoteReq(nil, r, []byte(`{"account_id": 2, "region": "eu"}`))
+
+	if b, err := fn(rr); err != nil || string(b) != "null" {
+		t.Errorf("expecting null for a 404 got %s (%v)", b, err)
+	}
+
+	if rr := c.newRemoteReq(nil, r, []byte(`{"account_id": null, "region": "eu"}`)); rr != nil {
+		t.Error("expecting no request for a null id")
+	}
+}
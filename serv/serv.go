@@ -14,8 +14,6 @@ import (
 	"github.com/dosco/super-graph/psql"
 	"github.com/dosco/super-graph/qcode"
 	"github.com/go-pg/pg"
-	"github.com/gobuffalo/flect"
-	"github.com/rs/zerolog"
 	"github.com/spf13/viper"
 )
 
@@ -29,34 +27,7 @@ const (
 	authFailBlockNever
 )
 
-var (
-	logger        *zerolog.Logger
-	conf          *config
-	db            *pg.DB
-	qcompile      *qcode.Compiler
-	pcompile      *psql.Compiler
-	authFailBlock int
-)
-
-func initLog() *zerolog.Logger {
-	logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).
-		With().
-		Timestamp().
-		Caller().
-		Logger()
-
-	return &logger
-	/*
-		log := logrus.New()
-		logger.Formatter = new(logrus.TextFormatter)
-		logger.Formatter.(*logrus.TextFormatter).DisableColors = false
-		logger.Formatter.(*logrus.TextFormatter).DisableTimestamp = true
-		logger.Level = logrus.TraceLevel
-		logger.Out = os.Stdout
-	*/
-}
-
-func initConf(path string) (*config, error) {
+func initConf(path string) (*Config, error) {
 	vi := viper.New()
 
 	vi.SetEnvPrefix("SG")
@@ -82,40 +53,54 @@ func initConf(path string) (*config, error) {
 	vi.BindEnv("HOST", "HOST")
 	vi.BindEnv("PORT", "PORT")
 
+	vi.SetDefault("rate_limit.roles.anon.rate", 10)
+	vi.SetDefault("rate_limit.roles.anon.burst", 20)
+	vi.SetDefault("rate_limit.roles.user.rate", 20)
+	vi.SetDefault("rate_limit.roles.user.burst", 40)
+
+	vi.SetDefault("database.slow_query.explain_sample", 0.1)
+	vi.SetDefault("database.slow_query.max_plans", maxSlowPlans)
+
+	vi.SetDefault("cache.size", 1000)
+	vi.SetDefault("cache.ttl", "30s")
+	vi.SetDefault("cache.channel", "super_graph_cache")
+
 	vi.SetDefault("auth.rails.max_idle", 80)
 	vi.SetDefault("auth.rails.max_active", 12000)
+	vi.SetDefault("auth.rails.connect_timeout", "1s")
+	vi.SetDefault("auth.rails.read_timeout", "500ms")
+	vi.SetDefault("auth.rails.write_timeout", "500ms")
+	vi.SetDefault("auth.rails.idle_timeout", "4m")
+	vi.SetDefault("auth.rails.session_cache_ttl", "10s")
 
 	if err := vi.ReadInConfig(); err != nil {
 		return nil, err
 	}
 
-	c := &config{}
+	c := &Config{}
 
 	if err := vi.Unmarshal(c); err != nil {
 		return nil, fmt.Errorf("unable to decode config, %v", err)
 	}
 
-	for k, v := range c.Inflections {
-		flect.AddPlural(k, v)
-	}
-
-	if len(c.DB.Tables) == 0 {
-		c.DB.Tables = c.DB.Fields
-	}
-
-	for i := range c.DB.Tables {
-		t := c.DB.Tables[i]
-		t.Name = flect.Pluralize(strings.ToLower(t.Name))
-	}
-
-	authFailBlock = getAuthFailBlock(c)
+	c.init()
+	c.file = vi.ConfigFileUsed()
 
 	//fmt.Printf("%#v", c)
 
 	return c, nil
 }
 
-func initDB(c *config) (*pg.DB, error) {
+func initDB(c *Config) (*pg.DB, error) {
+	db := pg.Connect(dbOptions(c))
+	if db == nil {
+		return nil, errors.New("failed to connect to postgres db")
+	}
+
+	return db, nil
+}
+
+func dbOptions(c *Config) *pg.Options {
 	opt := &pg.Options{
 		Addr:            strings.Join([]string{c.DB.Host, c.DB.Port}, ":"),
 		User:            c.DB.User,
@@ -125,7 +110,7 @@ func initDB(c *config) (*pg.DB, error) {
 	}
 
 	if c.DB.PoolSize != 0 {
-		opt.PoolSize = conf.DB.PoolSize
+		opt.PoolSize = c.DB.PoolSize
 	}
 
 	if c.DB.MaxRetries != 0 {
@@ -142,15 +127,10 @@ func initDB(c *config) (*pg.DB, error) {
 		}
 	}
 
-	db := pg.Connect(opt)
-	if db == nil {
-		return nil, errors.New("failed to connect to postgres db")
-	}
-
-	return db, nil
+	return opt
 }
 
-func initCompilers(c *config) (*qcode.Compiler, *psql.Compiler, error) {
+func initCompilers(c *Config, db *pg.DB) (*qcode.Compiler, *psql.Compiler, error) {
 	schema, err := psql.NewDBSchema(db, c.getAliasMap())
 	if err != nil {
 		return nil, nil, err
@@ -161,6 +141,9 @@ func initCompilers(c *config) (*qcode.Compiler, *psql.Compiler, error) {
 		FilterMap:     c.getFilterMap(),
 		Blacklist:     c.DB.Defaults.Blacklist,
 		KeepArgs:      false,
+		MaxDepth:      c.Limits.MaxDepth,
+		MaxSelects:    c.Limits.MaxSelects,
+		MaxCost:       c.Limits.MaxCost,
 	})
 
 	if err != nil {
@@ -183,38 +166,37 @@ func Init() {
 
 	logger = initLog()
 
-	conf, err = initConf(*path)
-	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to read config")
+	if flag.Arg(0) == "allow" {
+		os.Exit(cmdAllow(*path, flag.Args()[1:]))
 	}
 
-	logLevel, err := zerolog.ParseLevel(conf.LogLevel)
+	conf, err := initConf(*path)
 	if err != nil {
-		logger.Error().Err(err).Msg("error setting log_level")
+		logger.Fatal().Err(err).Msg("failed to read config")
 	}
-	zerolog.SetGlobalLevel(logLevel)
 
-	db, err = initDB(conf)
-	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to connect to database")
-	}
+	initLoggers(conf)
 
-	qcompile, pcompile, err = initCompilers(conf)
+	db, err := initDB(conf)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to connect to database")
 	}
 
-	if err := initResolvers(); err != nil {
-		logger.Fatal().Err(err).Msg("failed to initialized resolvers")
+	// the loggers from the config
+	sg, err := newSuperGraph(conf, db, *path, func(sg *SuperGraph) {
+		sg.log, sg.dbLog = logger, &dbLogger
+	})
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize")
 	}
+	sg.confLogs = true
 
-	initAllowList(*path)
-	initPreparedList()
-
-	startHTTP()
+	sg.initReload()
+	sg.startHTTP()
 }
 
-func startHTTP() {
+func (sg *SuperGraph) startHTTP() {
+	conf := sg.current().conf
 	hp := strings.SplitN(conf.HostPort, ":", 2)
 
 	if len(conf.Host) != 0 {
@@ -229,7 +211,7 @@ func startHTTP() {
 
 	srv := &http.Server{
 		Addr:           hostPort,
-		Handler:        routeHandler(),
+		Handler:        sg.routeHandler(),
 		ReadTimeout:    5 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
@@ -244,16 +226,20 @@ func startHTTP() {
 		if err := srv.Shutdown(context.Background()); err != nil {
 			logger.Error().Err(err).Msg("shutdown signal received")
 		}
-		close(idleConnsClosed)
-	}()
 
-	srv.RegisterOnShutdown(func() {
-		if err := db.Close(); err != nil {
+		// the requests are done so their spans have all finished
+		sg.Close()
+
+		if err := sg.db.Close(); err != nil {
 			logger.Error().Err(err).Msg("db closed")
 		}
-	})
+		close(idleConnsClosed)
+	}()
 
-	fmt.Printf("%s listening on %s (%s)\n", serverName, hostPort, conf.Env)
+	logger.Info().
+		Str("addr", hostPort).
+		Str("env", conf.Env).
+		Msgf("%s listening", serverName)
 
 	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 		logger.Error().Err(err).Msg("server closed")
@@ -262,10 +248,33 @@ func startHTTP() {
 	<-idleConnsClosed
 }
 
-func routeHandler() http.Handler {
+func (sg *SuperGraph) routeHandler() http.Handler {
+	conf := sg.current().conf
 	mux := http.NewServeMux()
 
-	mux.Handle("/api/v1/graphql", withAuth(apiv1Http))
+	mux.Handle("/api/v1/graphql", sg.Handler())
+
+	// only for development since it shows the sql and
+	// query plans
+	if conf.EnableExplain {
+		mux.Handle("/api/v1/explain", sg.withSnapshot(func(s *snapshot) http.HandlerFunc {
+			return s.apiExplainHandler
+		}))
+	}
+	mux.HandleFunc("/health", health)
+	mux.HandleFunc("/ready", sg.ready)
+
+	if s := conf.Admin.Secret; len(s) != 0 {
+		mux.Handle("/admin/reload", withAdminAuth(s, sg.adminReload))
+		mux.Handle("/admin/config", withAdminAuth(s, sg.adminGet(sg.adminConfig)))
+		mux.Handle("/admin/allow_list", withAdminAuth(s, sg.adminGet(sg.adminAllowList)))
+		mux.Handle("/admin/schema", withAdminAuth(s, sg.adminGet(sg.adminSchema)))
+		mux.Handle("/admin/prepared", withAdminAuth(s, sg.adminGet(sg.adminPrepared)))
+		mux.Handle("/admin/slow_queries", withAdminAuth(s, sg.adminGet(sg.adminSlowQueries)))
+	}
+	if sg.metrics != nil {
+		mux.Handle("/metrics", sg.MetricsHandler())
+	}
 	if conf.WebUI {
 		mux.Handle("/", http.FileServer(_escFS(false)))
 	}
@@ -295,7 +304,7 @@ func getConfigName() string {
 	return "dev"
 }
 
-func getAuthFailBlock(c *config) int {
+func getAuthFailBlock(c *Config) int {
 	switch c.AuthFailBlock {
 	case "always":
 		return authFailBlockAlways
@@ -0,0 +1,479 @@
+package serv
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	maxSessionCacheItems = 10000
+	maxClusterRedirects  = 3
+	clusterSlots         = 16384
+)
+
+var (
+	errNoSentinel = errors.New("no redis sentinel available")
+)
+
+// sessionStore fetches the raw session data saved by Rails for
+// a session key.
+type sessionStore interface {
+	get(key string) ([]byte, error)
+
+	// ping checks the store can be reached
+	ping() error
+}
+
+func newSessionStore(c *Config) (sessionStore, error) {
+	ru := c.Auth.Rails.URL
+
+	switch {
+	case strings.HasPrefix(ru, "memcache:"):
+		return newMemcacheStore(c)
+
+	case strings.HasPrefix(ru, "redis-sentinel:"):
+		return newRedisSentinelStore(c)
+
+	case strings.HasPrefix(ru, "redis-cluster:"):
+		return newRedisClusterStore(c)
+
+	case strings.HasPrefix(ru, "redis:"), strings.HasPrefix(ru, "rediss:"):
+		return newRedisStore(c)
+	}
+
+	return nil, fmt.Errorf("unsupported session store url '%s'", ru)
+}
+
+// memcache
+
+type memcacheStore struct {
+	mc *memcache.Client
+}
+
+func newMemcacheStore(c *Config) (*memcacheStore, error) {
+	rURL, err := url.Parse(c.Auth.Rails.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	// memcache://host1:11211,host2:11211
+	mc := memcache.New(strings.Split(rURL.Host, ",")...)
+	mc.Timeout = c.Auth.Rails.ReadTimeout
+	mc.MaxIdleConns = c.Auth.Rails.MaxIdle
+
+	return &memcacheStore{mc}, nil
+}
+
+func (s *memcacheStore) get(key string) ([]byte, error) {
+	item, err := s.mc.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+// there's no ping in memcache so a missing key is fetched instead
+func (s *memcacheStore) ping() error {
+	if _, err := s.mc.Get("super_graph:ping"); err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// redis and rediss (tls)
+
+type redisStore struct {
+	rp *redis.Pool
+}
+
+func newRedisStore(c *Config) (*redisStore, error) {
+	opts := redisDialOptions(c)
+
+	dial := func() (redis.Conn, error) {
+		return redis.DialURL(c.Auth.Rails.URL, opts...)
+	}
+
+	return &redisStore{newRedisPool(c, dial)}, nil
+}
+
+func (s *redisStore) get(key string) ([]byte, error) {
+	conn := s.rp.Get()
+	defer conn.Close()
+
+	return redis.Bytes(conn.Do("GET", key))
+}
+
+func (s *redisStore) ping() error {
+	conn := s.rp.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+	return err
+}
+
+// redis-sentinel://:password@host1:26379,host2:26379/master_name
+
+func newRedisSentinelStore(c *Config) (*redisStore, error) {
+	u, err := url.Parse(c.Auth.Rails.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := strings.Split(u.Host, ",")
+	master := strings.Trim(u.Path, "/")
+
+	if len(master) == 0 {
+		return nil, errors.New("no redis sentinel master name defined")
+	}
+
+	opts := redisDialOptions(c)
+
+	if pwd, ok := u.User.Password(); ok {
+		opts = append(opts, redis.DialPassword(pwd))
+	}
+
+	// sentinels are only used to find the current master so no
+	// password is sent to them
+	sopts := redisTimeoutOptions(c)
+
+	dial := func() (redis.Conn, error) {
+		addr, err := sentinelMaster(addrs, master, sopts)
+		if err != nil {
+			return nil, err
+		}
+		return redis.Dial("tcp", addr, opts...)
+	}
+
+	return &redisStore{newRedisPool(c, dial)}, nil
+}
+
+func sentinelMaster(addrs []string, master string, opts []redis.DialOption) (string, error) {
+	err := errNoSentinel
+
+	for _, addr := range addrs {
+		var sc redis.Conn
+
+		sc, err = redis.Dial("tcp", addr, opts...)
+		if err != nil {
+			continue
+		}
+
+		var res []string
+		res, err = redis.Strings(sc.Do("SENTINEL", "get-master-addr-by-name", master))
+		sc.Close()
+
+		if err != nil {
+			continue
+		}
+
+		if len(res) != 2 {
+			err = fmt.Errorf("redis sentinel: unknown master '%s'", master)
+			continue
+		}
+
+		return net.JoinHostPort(res[0], res[1]), nil
+	}
+
+	return "", err
+}
+
+// redis-cluster://:password@host1:6379,host2:6379
+
+type redisClusterStore struct {
+	sync.RWMutex
+	c     *Config
+	u     *url.URL
+	seeds []string
+	slots map[uint16]string
+	pools map[string]*redis.Pool
+}
+
+func newRedisClusterStore(c *Config) (*redisClusterStore, error) {
+	u, err := url.Parse(c.Auth.Rails.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &redisClusterStore{
+		c:     c,
+		u:     u,
+		seeds: strings.Split(u.Host, ","),
+		slots: make(map[uint16]string),
+		pools: make(map[string]*redis.Pool),
+	}
+
+	return s, nil
+}
+
+func (s *redisClusterStore) get(key string) ([]byte, error) {
+	slot := clusterSlot(key)
+
+	s.RLock()
+	addr, ok := s.slots[slot]
+	s.RUnlock()
+
+	seed := int(slot)
+	if !ok {
+		addr = s.seeds[seed%len(s.seeds)]
+	}
+
+	for i := 0; i <= maxClusterRedirects+len(s.seeds); i++ {
+		conn := s.pool(addr).Get()
+		v, err := redis.Bytes(conn.Do("GET", key))
+		conn.Close()
+
+		if err == nil || err == redis.ErrNil {
+			return v, err
+		}
+
+		// node is unreachable so try the next seed node
+		re, ok := err.(redis.Error)
+		if !ok {
+			seed++
+			addr = s.seeds[seed%len(s.seeds)]
+			continue
+		}
+
+		// MOVED 3999 127.0.0.1:6381 or ASK 3999 127.0.0.1:6381
+		f := strings.Fields(string(re))
+		if len(f) != 3 || (f[0] != "MOVED" && f[0] != "ASK") {
+			return nil, err
+		}
+
+		// the slot is being migrated so only this key is asked for
+		// on the new node and the slots are left as is
+		if f[0] == "ASK" {
+			return s.asking(f[2], key)
+		}
+		addr = f[2]
+
+		if n, err := strconv.Atoi(f[1]); err == nil {
+			s.Lock()
+			s.slots[uint16(n)] = addr
+			s.Unlock()
+		}
+	}
+
+	return nil, fmt.Errorf("redis cluster: failed to fetch key '%s'", key)
+}
+
+func (s *redisClusterStore) asking(addr, key string) ([]byte, error) {
+	conn := s.pool(addr).Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("ASKING"); err != nil {
+		return nil, err
+	}
+
+	return redis.Bytes(conn.Do("GET", key))
+}
+
+// ping is ok as long as one of the seed nodes can be reached
+func (s *redisClusterStore) ping() error {
+	var err error
+
+	for _, addr := range s.seeds {
+		conn := s.pool(addr).Get()
+		_, err = conn.Do("PING")
+		conn.Close()
+
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (s *redisClusterStore) pool(addr string) *redis.Pool {
+	s.RLock()
+	rp, ok := s.pools[addr]
+	s.RUnlock()
+
+	if ok {
+		return rp
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if rp, ok := s.pools[addr]; ok {
+		return rp
+	}
+
+	opts := redisDialOptions(s.c)
+
+	if pwd, ok := s.u.User.Password(); ok {
+		opts = append(opts, redis.DialPassword(pwd))
+	}
+
+	rp = newRedisPool(s.c, func() (redis.Conn, error) {
+		return redis.Dial("tcp", addr, opts...)
+	})
+	s.pools[addr] = rp
+
+	return rp
+}
+
+// clusterSlot returns the redis cluster hash slot for a key
+// including support for {hash_tags}
+func clusterSlot(key string) uint16 {
+	if s := strings.IndexByte(key, '{'); s != -1 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return crc16(key) % clusterSlots
+}
+
+// crc16 (xmodem) as used by redis cluster
+func crc16(s string) uint16 {
+	var crc uint16
+
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+
+		for n := 0; n < 8; n++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func newRedisPool(c *Config, dial func() (redis.Conn, error)) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     c.Auth.Rails.MaxIdle,
+		MaxActive:   c.Auth.Rails.MaxActive,
+		IdleTimeout: c.Auth.Rails.IdleTimeout,
+		Dial:        dial,
+		TestOnBorrow: func(conn redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+	}
+}
+
+func redisTimeoutOptions(c *Config) []redis.DialOption {
+	return []redis.DialOption{
+		redis.DialConnectTimeout(c.Auth.Rails.ConnectTimeout),
+		redis.DialReadTimeout(c.Auth.Rails.ReadTimeout),
+		redis.DialWriteTimeout(c.Auth.Rails.WriteTimeout),
+	}
+}
+
+func redisDialOptions(c *Config) []redis.DialOption {
+	opts := redisTimeoutOptions(c)
+
+	// a password in the url takes precedence
+	if len(c.Auth.Rails.Password) != 0 {
+		opts = append(opts, redis.DialPassword(c.Auth.Rails.Password))
+	}
+
+	return opts
+}
+
+// sessionCache is a short lived in-process cache of session keys
+// to user ids. It keeps requests working through short session
+// store outages and cuts down on store lookups. Entries are used
+// for the ttl and when the store fails for another ttl after that.
+type sessionCache struct {
+	sync.Mutex
+	ttl   time.Duration
+	items map[string]sessionItem
+}
+
+type sessionItem struct {
+	userID string
+	exp    time.Time
+}
+
+func newSessionCache(ttl time.Duration) *sessionCache {
+	return &sessionCache{
+		ttl:   ttl,
+		items: make(map[string]sessionItem),
+	}
+}
+
+func (sc *sessionCache) get(key string) (string, bool) {
+	if sc.ttl <= 0 {
+		return "", false
+	}
+
+	sc.Lock()
+	defer sc.Unlock()
+
+	v, ok := sc.items[key]
+	if !ok {
+		return "", false
+	}
+
+	if time.Now().After(v.exp) {
+		return "", false
+	}
+
+	return v.userID, true
+}
+
+// stale returns the user id cached for the session even when it's
+// expired, use it only when the session store fails
+func (sc *sessionCache) stale(key string) (string, bool) {
+	if sc.ttl <= 0 {
+		return "", false
+	}
+
+	sc.Lock()
+	defer sc.Unlock()
+
+	v, ok := sc.items[key]
+	if !ok {
+		return "", false
+	}
+
+	if time.Now().After(v.exp.Add(sc.ttl)) {
+		delete(sc.items, key)
+		return "", false
+	}
+
+	return v.userID, true
+}
+
+func (sc *sessionCache) set(key, userID string) {
+	if sc.ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	sc.Lock()
+	defer sc.Unlock()
+
+	if len(sc.items) >= maxSessionCacheItems {
+		for k, v := range sc.items {
+			if now.After(v.exp.Add(sc.ttl)) {
+				delete(sc.items, k)
+			}
+		}
+	}
+
+	if len(sc.items) >= maxSessionCacheItems {
+		sc.items = make(map[string]sessionItem)
+	}
+
+	sc.items[key] = sessionItem{userID, now.Add(sc.ttl)}
+}
@@ -0,0 +1,148 @@
+package serv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestClusterSlot(t *testing.T) {
+	if v := crc16("123456789"); v != 0x31C3 {
+		t.Fatalf("Expecting crc16 0x31C3 got 0x%X", v)
+	}
+
+	if v := clusterSlot("foo"); v != 12182 {
+		t.Fatalf("Expecting slot 12182 got %d", v)
+	}
+
+	if clusterSlot("{user1000}.following") != clusterSlot("{user1000}.followers") {
+		t.Fatal("Hash tagged keys should map to the same slot")
+	}
+}
+
+func TestSessionCache(t *testing.T) {
+	sc := newSessionCache(50 * time.Millisecond)
+	sc.set("abc", "1")
+
+	if v, ok := sc.get("abc"); !ok || v != "1" {
+		t.Fatalf("Expecting userID 1 got %s", v)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if _, ok := sc.get("abc"); ok {
+		t.Fatal("Expecting session to have expired")
+	}
+
+	if v, ok := sc.stale("abc"); !ok || v != "1" {
+		t.Fatal("Expecting the expired session to be kept for store failures")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if _, ok := sc.stale("abc"); ok {
+		t.Fatal("Expecting session to have been removed")
+	}
+
+	sc = newSessionCache(0)
+	sc.set("abc", "1")
+
+	if _, ok := sc.get("abc"); ok {
+		t.Fatal("Expecting session cache to be disabled")
+	}
+}
+
+type testRailsStore struct {
+	data []byte
+	err  error
+}
+
+func (s *testRailsStore) get(key string) ([]byte, error) { return s.data, s.err }
+func (s *testRailsStore) ping() error                    { return s.err }
+
+func TestRailsStoreFailure(t *testing.T) {
+	c := &Config{}
+	c.Auth.Cookie = "_app_session"
+	c.Auth.Rails.SessionCacheTTL = 20 * time.Millisecond
+
+	store := &testRailsStore{data: []byte(`{"user_id": 5}`)}
+
+	var userID interface{}
+	h, err := railsStoreHandler(c, store, testLog(), func(w http.ResponseWriter, r *http.Request) {
+		userID = r.Context().Value(userIDKey)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := func() interface{} {
+		userID = nil
+		r := httptest.NewRequest("POST", "/api/v1/graphql", nil)
+		r.AddCookie(&http.Cookie{Name: "_app_session", Value: "abc"})
+		h(httptest.NewRecorder(), r)
+		return userID
+	}
+
+	if v := req(); v != "5" {
+		t.Fatalf("expecting user 5 got %v", v)
+	}
+
+	// the cached session has expired and the store is down
+	time.Sleep(30 * time.Millisecond)
+	store.data, store.err = nil, errors.New("connection refused")
+
+	if v := req(); v != "5" {
+		t.Errorf("expecting the cached user while the store is down got %v", v)
+	}
+
+	// the session was deleted from the store
+	store.err = redis.ErrNil
+
+	if v := req(); v != nil {
+		t.Errorf("expecting no user for a deleted session got %v", v)
+	}
+}
+
+func TestRedisClusterAsk(t *testing.T) {
+	var asking bool
+
+	// the slot is being migrated to n2
+	n2 := fakeRedis(t, func(args []string) string {
+		switch {
+		case args[0] == "ASKING":
+			asking = true
+			return "+OK\r\n"
+		case args[0] == "GET" && asking:
+			return "$4\r\ndata\r\n"
+		}
+		return fmt.Sprintf("-MOVED %d 127.0.0.1:1\r\n", clusterSlot(args[1]))
+	})
+	defer n2.Close()
+
+	n1 := fakeRedis(t, func(args []string) string {
+		return fmt.Sprintf("-ASK %d %s\r\n", clusterSlot(args[1]), n2.Addr())
+	})
+	defer n1.Close()
+
+	c := &Config{}
+	c.Auth.Rails.URL = "redis-cluster://" + n1.Addr().String()
+
+	s, err := newRedisClusterStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := s.get("session:abc")
+	if err != nil || string(v) != "data" {
+		t.Fatalf("expecting the key from the asked node got '%s' %v", v, err)
+	}
+
+	if len(s.slots) != 0 {
+		t.Error("expecting the slots to be left as is for an ASK")
+	}
+}
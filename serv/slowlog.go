@@ -0,0 +1,191 @@
+package serv
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+const (
+	maxSlowPlans = 50
+)
+
+// slowLog logs queries slower than database.slow_query.threshold and
+// keeps the EXPLAIN plans for a sample of them, a nil slowLog
+// does nothing
+type slowLog struct {
+	threshold time.Duration
+	explain   bool
+	sample    float64
+	max       int
+
+	// only one EXPLAIN runs at a time so slow queries don't pile
+	// more load on an already slow database
+	running int32
+
+	sync.Mutex
+	plans []*slowPlan
+}
+
+type slowPlan struct {
+	Time      time.Time       `json:"time"`
+	RequestID string          `json:"request_id"`
+	Operation string          `json:"operation,omitempty"`
+	QueryHash string          `json:"query_hash,omitempty"`
+	Duration  float64         `json:"duration_ms"`
+	SQL       string          `json:"sql"`
+	Vars      variables       `json:"variables,omitempty"`
+	SeqScans  []string        `json:"seq_scans,omitempty"`
+	Plan      json.RawMessage `json:"plan"`
+}
+
+func newSlowLog(c *Config) *slowLog {
+	sq := c.DB.SlowQuery
+
+	if sq.Threshold <= 0 {
+		return nil
+	}
+
+	sl := &slowLog{
+		threshold: sq.Threshold,
+		explain:   sq.Explain,
+		sample:    sq.ExplainSample,
+		max:       sq.MaxPlans,
+	}
+
+	if sl.max <= 0 {
+		sl.max = maxSlowPlans
+	}
+
+	return sl
+}
+
+// slowQuery is called after a query is run on db, sql is logged and
+// query is explained along with the args. For queries that are not
+// prepared sql is the template with the variables left out.
+func (c *coreContext) slowQuery(db *pg.DB, st time.Time, sql, query string, args []interface{}) {
+	sl := c.slowLog
+	d := time.Since(st)
+
+	if sl == nil || d < sl.threshold {
+		return
+	}
+
+	p := &slowPlan{
+		Time:      st,
+		RequestID: c.reqID,
+		Operation: c.req.OpName,
+		Duration:  float64(d) / float64(time.Millisecond),
+		SQL:       sql,
+		Vars:      c.req.Vars,
+	}
+
+	if len(c.req.Query) != 0 {
+		p.QueryHash = gqlHash([]byte(c.req.Query))
+	}
+
+	c.log.Warn().
+		Str("request_id", p.RequestID).
+		Str("operation", p.Operation).
+		Str("query_hash", p.QueryHash).
+		Dur("duration", d).
+		Str("sql", p.SQL).
+		Interface("variables", p.Vars).
+		Msg("slow query")
+
+	if !sl.explain || rand.Float64() >= sl.sample {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&sl.running, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&sl.running, 0)
+
+		plan, err := explainQuery(db, explainAnalyze, query, args)
+		if err != nil {
+			c.log.Warn().Err(err).Str("request_id", p.RequestID).Msg("failed to explain slow query")
+			return
+		}
+
+		p.Plan = plan
+		p.SeqScans = seqScans(plan)
+
+		sl.add(p)
+	}()
+}
+
+func (sl *slowLog) add(p *slowPlan) {
+	sl.Lock()
+	defer sl.Unlock()
+
+	if len(sl.plans) >= sl.max {
+		copy(sl.plans, sl.plans[1:])
+		sl.plans = sl.plans[:len(sl.plans)-1]
+	}
+	sl.plans = append(sl.plans, p)
+}
+
+// list returns the plans newest first
+func (sl *slowLog) list() []*slowPlan {
+	list := []*slowPlan{}
+
+	if sl == nil {
+		return list
+	}
+
+	sl.Lock()
+	defer sl.Unlock()
+
+	for i := len(sl.plans) - 1; i >= 0; i-- {
+		list = append(list, sl.plans[i])
+	}
+
+	return list
+}
+
+type planNode struct {
+	NodeType string     `json:"Node Type"`
+	Relation string     `json:"Relation Name"`
+	Plans    []planNode `json:"Plans"`
+}
+
+// seqScans returns the tables read with a sequential scan in the plan,
+// these often point to a missing index on a join column
+func seqScans(plan json.RawMessage) []string {
+	var res []struct {
+		Plan planNode
+	}
+
+	if err := json.Unmarshal(plan, &res); err != nil {
+		return nil
+	}
+
+	var tables []string
+	seen := make(map[string]struct{})
+
+	var walk func(n *planNode)
+	walk = func(n *planNode) {
+		if n.NodeType == "Seq Scan" {
+			if _, ok := seen[n.Relation]; !ok {
+				seen[n.Relation] = struct{}{}
+				tables = append(tables, n.Relation)
+			}
+		}
+		for i := range n.Plans {
+			walk(&n.Plans[i])
+		}
+	}
+
+	for i := range res {
+		walk(&res[i].Plan)
+	}
+
+	return tables
+}
@@ -0,0 +1,79 @@
+package serv
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeqScans(t *testing.T) {
+	plan := json.RawMessage(`[{"Plan": {
+		"Node Type": "Nested Loop",
+		"Plans": [
+			{"Node Type": "Seq Scan", "Relation Name": "products"},
+			{"Node Type": "Index Scan", "Relation Name": "users"},
+			{"Node Type": "Hash", "Plans": [
+				{"Node Type": "Seq Scan", "Relation Name": "customers"},
+				{"Node Type": "Seq Scan", "Relation Name": "products"}
+			]}
+		]
+	}}]`)
+
+	tables := seqScans(plan)
+
+	if len(tables) != 2 || tables[0] != "products" || tables[1] != "customers" {
+		t.Errorf("expecting products and customers got %v", tables)
+	}
+}
+
+func TestSlowLogPlans(t *testing.T) {
+	sl := &slowLog{max: 2}
+
+	for _, v := range []string{"a", "b", "c"} {
+		sl.add(&slowPlan{RequestID: v})
+	}
+
+	list := sl.list()
+
+	if len(list) != 2 || list[0].RequestID != "c" || list[1].RequestID != "b" {
+		t.Errorf("expecting the two newest plans got %+v", list)
+	}
+
+	if l := (*slowLog)(nil).list(); l == nil || len(l) != 0 {
+		t.Error("expecting an empty list when the slow query log is disabled")
+	}
+}
+
+func TestSlowQuery(t *testing.T) {
+	buf, _, restore := testLoggers(&Config{})
+	defer restore()
+
+	c := &Config{}
+	c.DB.SlowQuery.Threshold = 10 * time.Millisecond
+
+	ctx := &coreContext{
+		Context:    context.Background(),
+		SuperGraph: &SuperGraph{log: logger, slowLog: newSlowLog(c)},
+		snapshot:   &snapshot{conf: c},
+		reqID:      "abc-123",
+	}
+	ctx.req.OpName = "getProducts"
+	ctx.req.Vars = variables{"id": float64(5)}
+
+	ctx.slowQuery(nil, time.Now(), `SELECT {{id}}`, `SELECT 5`, nil)
+
+	if buf.Len() != 0 {
+		t.Fatalf("expecting a fast query not to be logged got %s", buf.String())
+	}
+
+	ctx.slowQuery(nil, time.Now().Add(-time.Second), `SELECT {{id}}`, `SELECT 5`, nil)
+
+	for _, v := range []string{`"slow query"`, `"request_id":"abc-123"`,
+		`"operation":"getProducts"`, `"sql":"SELECT {{id}}"`, `"variables":{"id":5}`} {
+		if !strings.Contains(buf.String(), v) {
+			t.Errorf("expecting %s in %s", v, buf.String())
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package serv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/rs/zerolog"
+)
+
+// SuperGraph compiles GraphQL queries into SQL and runs them on
+// Postgres. Use it to embed super graph in your own Go service.
+//
+//	conf, err := serv.ReadInConfig("./config")
+//	sg, err := serv.NewSuperGraph(conf, db)
+//
+//	http.Handle("/graphql", myMiddleware(sg.Handler()))
+//	data, err := sg.GraphQL(ctx, "{ products { id name } }", nil)
+type SuperGraph struct {
+	db        *pg.DB
+	respCache *responseCache
+	apqList   *lruCache
+	tracer    *tracer
+	metrics   *metrics
+	slowLog   *slowLog
+	replicas  *replicaSet
+	sessions  sessionStore
+	rates     rateStore
+
+	// the generated sql is logged to dbLog at the debug level
+	log   *zerolog.Logger
+	dbLog *zerolog.Logger
+
+	// the current *snapshot, reload swaps in a new one
+	snap atomic.Value
+
+	// only one reload is run at a time
+	reloadMu sync.Mutex
+
+	// path to look for config files in
+	confPath string
+
+	// the log levels are set from the config, only when run as a
+	// server since the loggers are the caller's when used as a library
+	confLogs bool
+}
+
+// Option configures a SuperGraph created with NewSuperGraph
+type Option func(*SuperGraph)
+
+// WithLogger sets the logger used by super graph, the generated sql is
+// logged to it at the debug level. By default it logs to stderr.
+func WithLogger(l zerolog.Logger) Option {
+	return func(sg *SuperGraph) {
+		sg.log = &l
+		sg.dbLog = &l
+	}
+}
+
+// ReadInConfig reads the config file for the current environment
+// (GO_ENV) from the path or ./config
+func ReadInConfig(path string) (*Config, error) {
+	if logger == nil {
+		logger = initLog()
+	}
+	return initConf(path)
+}
+
+// NewSuperGraph creates a SuperGraph using an existing database
+// connection, the database schema is read when it's created. The
+// log_format and log levels in the config are not used, pass your own
+// logger using WithLogger.
+func NewSuperGraph(conf *Config, db *pg.DB, opts ...Option) (*SuperGraph, error) {
+	conf.init()
+
+	return newSuperGraph(conf, db, "", opts...)
+}
+
+func newSuperGraph(conf *Config, db *pg.DB, path string, opts ...Option) (*SuperGraph, error) {
+	var err error
+
+	sg := &SuperGraph{
+		db:       db,
+		rates:    newMemRateStore(),
+		confPath: path,
+	}
+
+	for _, o := range opts {
+		o(sg)
+	}
+
+	if sg.log == nil {
+		sg.log = initLog()
+	}
+
+	if sg.dbLog == nil {
+		l := zerolog.Nop()
+		sg.dbLog = &l
+	}
+
+	sg.tracer, err = newTracer(conf, sg.log)
+	if err != nil {
+		return nil, err
+	}
+
+	sg.metrics = newMetrics(conf)
+	sg.slowLog = newSlowLog(conf)
+
+	sg.replicas, err = initReplicas(conf, sg.log)
+	if err != nil {
+		return nil, err
+	}
+
+	sg.sessions, err = initSessionStore(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	sg.respCache, err = initCache(conf, db, sg.log)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := sg.newSnapshot(conf)
+	if err != nil {
+		return nil, err
+	}
+	sg.snap.Store(s)
+
+	sg.initPersistedQueries(s.allowList)
+
+	return sg, nil
+}
+
+// GraphQL runs the query and returns the data from the response. Use
+// WithUserID to set the user for queries that need one. When a remote
+// join fails the data is returned along with an error, the failed
+// fields are set to null.
+func (sg *SuperGraph) GraphQL(ctx context.Context, query string,
+	vars map[string]interface{}) (json.RawMessage, error) {
+
+	s := sg.acquire()
+	defer s.release()
+
+	ctx, sp := sg.tracer.startTrace(ctx, "", "graphql")
+	defer sp.finish()
+
+	c := &coreContext{Context: ctx, SuperGraph: sg, snapshot: s, reqID: requestID(nil)}
+	c.req.Query = query
+	c.req.Vars = vars
+
+	if c.authFailBlock == authFailBlockAlways && authCheck(c) == false {
+		sp.setError(errUnauthorized)
+		return nil, errUnauthorized
+	}
+
+	st := time.Now()
+
+	data, err := c.execQuery(nil)
+	sg.metrics.request(empty, errorStatus(err), st)
+	c.logRequest(st, len(data), err)
+
+	if err != nil {
+		sp.setError(err)
+		return nil, err
+	}
+
+	if len(c.res.Errors) != 0 {
+		return json.RawMessage(data), gqlErrors(c.res.Errors)
+	}
+
+	return json.RawMessage(data), nil
+}
+
+// Close stops the background work of the SuperGraph and sends the
+// traces still buffered. The database connection passed to
+// NewSuperGraph is left open.
+func (sg *SuperGraph) Close() {
+	sg.tracer.close()
+	sg.replicas.close()
+}
+
+// Handler returns the GraphQL http endpoint including the configured
+// authentication and rate limiting
+func (sg *SuperGraph) Handler() http.Handler {
+	return sg.withMetrics(sg.withSnapshot(func(s *snapshot) http.HandlerFunc {
+		return s.apiHandler
+	}))
+}
+
+// MetricsHandler returns the prometheus metrics endpoint, metrics are
+// only recorded when enable_metrics is set
+func (sg *SuperGraph) MetricsHandler() http.Handler {
+	if sg.metrics == nil {
+		return http.NotFoundHandler()
+	}
+	return http.HandlerFunc(sg.metricsHandler)
+}
+
+// WithReadPrimary returns a context that sends the GraphQL queries
+// to the primary database instead of a replica, use it to read
+// data that was just written
+func WithReadPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readPrimaryKey, true)
+}
+
+// WithUserID returns a context with the id of the authenticated user
+// to use with GraphQL
+func WithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDKey, userID)
+}
@@ -0,0 +1,130 @@
+package serv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/go-pg/pg"
+	"github.com/rs/zerolog"
+)
+
+// fakePostgres accepts connections and answers every query with no
+// rows, enough to read an empty database schema
+func fakePostgres(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			cn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go servePostgres(cn)
+		}
+	}()
+
+	return ln
+}
+
+func servePostgres(cn net.Conn) {
+	defer cn.Close()
+
+	rd := bufio.NewReader(cn)
+
+	msg := func(c byte, b string) {
+		var hdr [5]byte
+		hdr[0] = c
+		binary.BigEndian.PutUint32(hdr[1:], uint32(len(b)+4))
+		cn.Write(append(hdr[:], b...))
+	}
+
+	read := func(typed bool) (byte, bool) {
+		var c byte
+		if typed {
+			c, _ = rd.ReadByte()
+		}
+		var n uint32
+		if err := binary.Read(rd, binary.BigEndian, &n); err != nil {
+			return 0, false
+		}
+		_, err := io.CopyN(ioutil.Discard, rd, int64(n)-4)
+		return c, err == nil
+	}
+
+	// startup, the password is not asked for
+	if _, ok := read(false); !ok {
+		return
+	}
+	msg('R', "\x00\x00\x00\x00")
+	msg('Z', "I")
+
+	for {
+		c, ok := read(true)
+		if !ok || c == 'X' {
+			return
+		}
+		msg('C', "SELECT 0\x00")
+		msg('Z', "I")
+	}
+}
+
+func TestSuperGraphLogger(t *testing.T) {
+	ln := fakePostgres(t)
+	defer ln.Close()
+
+	db := pg.Connect(&pg.Options{Addr: ln.Addr().String(), User: "postgres"})
+	defer db.Close()
+
+	var buf1, buf2 bytes.Buffer
+	l := logger
+
+	sg1, err := NewSuperGraph(&Config{}, db, WithLogger(zerolog.New(&buf1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sg1.Close()
+
+	sg2, err := NewSuperGraph(&Config{}, db, WithLogger(zerolog.New(&buf2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sg2.Close()
+
+	q1 := "query getProducts { products { id } }"
+	q2 := "query getUsers { users { id } }"
+
+	ctx := WithUserID(context.Background(), "1")
+
+	// the schema is empty so the queries fail
+	if _, err := sg1.GraphQL(ctx, q1, nil); err == nil {
+		t.Error("expecting an error for a table not in the schema")
+	}
+
+	if _, err := sg2.GraphQL(ctx, q2, nil); err == nil {
+		t.Error("expecting an error for a table not in the schema")
+	}
+
+	h1, h2 := gqlHash([]byte(q1)), gqlHash([]byte(q2))
+
+	if !strings.Contains(buf1.String(), h1) || strings.Contains(buf1.String(), h2) {
+		t.Errorf("expecting only the first query in the first logger got %s", buf1.String())
+	}
+
+	if !strings.Contains(buf2.String(), h2) || strings.Contains(buf2.String(), h1) {
+		t.Errorf("expecting only the second query in the second logger got %s", buf2.String())
+	}
+
+	if logger != l {
+		t.Error("expecting the package logger to be left as is")
+	}
+}
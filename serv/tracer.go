@@ -0,0 +1,466 @@
+package serv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	traceparentHeader = "traceparent"
+
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+	defaultOTLPURL    = "http://localhost:4318/v1/traces"
+)
+
+type spanKey struct{}
+
+// span kinds as used by OpenTelemetry
+const (
+	spanInternal = iota + 1
+	spanServer
+	spanClient
+)
+
+// tracer creates the spans for a request and hands them to the
+// exporter once they end. A nil tracer creates no spans.
+type tracer struct {
+	service string
+	exp     spanExporter
+}
+
+// spanExporter sends finished spans to a tracing backend, close
+// sends any spans still buffered
+type spanExporter interface {
+	export(s *span)
+	close()
+}
+
+// span is a timed operation within a trace, the ids follow the
+// w3c trace context format so spans can be joined up with the
+// ones from other services
+type span struct {
+	tr       *tracer
+	name     string
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	kind     int
+	sampled  bool
+	start    time.Time
+	end      time.Time
+
+	mu    sync.Mutex
+	attrs []spanAttr
+	err   string
+}
+
+type spanAttr struct {
+	key   string
+	value string
+}
+
+func newTracer(c *Config, log *zerolog.Logger) (*tracer, error) {
+	t := &tracer{service: c.Telemetry.ServiceName}
+
+	if len(t.service) == 0 {
+		t.service = c.AppName
+	}
+
+	switch c.Telemetry.Exporter {
+	case "":
+		return nil, nil
+
+	case "log":
+		t.exp = &logExporter{log}
+
+	case "otlp":
+		t.exp = newOTLPExporter(t.service, c.Telemetry.Endpoint, log)
+
+	case "memory":
+		t.exp = &memoryExporter{}
+
+	default:
+		return nil, fmt.Errorf("telemetry: unknown exporter '%s'", c.Telemetry.Exporter)
+	}
+
+	return t, nil
+}
+
+// close stops the exporter once the spans still buffered are sent
+func (t *tracer) close() {
+	if t != nil {
+		t.exp.close()
+	}
+}
+
+// startTrace starts the root span for a request, when traceparent
+// is set the span continues the trace of the calling service
+func (t *tracer) startTrace(ctx context.Context, traceparent, name string) (
+	context.Context, *span) {
+
+	if t == nil {
+		return ctx, nil
+	}
+
+	if p, ok := parseTraceparent(traceparent); ok {
+		p.tr = t
+		ctx = context.WithValue(ctx, spanKey{}, p)
+
+	} else if spanFromContext(ctx) == nil {
+		p := &span{tr: t, sampled: true}
+		rand.Read(p.traceID[:])
+		ctx = context.WithValue(ctx, spanKey{}, p)
+	}
+
+	ctx, s := startSpan(ctx, name)
+	s.kind = spanServer
+
+	return ctx, s
+}
+
+// startSpan starts a child of the span in the context, no span is
+// started when the request is not being traced
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	p := spanFromContext(ctx)
+	if p == nil {
+		return ctx, nil
+	}
+
+	s := &span{
+		tr:       p.tr,
+		name:     name,
+		traceID:  p.traceID,
+		parentID: p.spanID,
+		kind:     spanInternal,
+		sampled:  p.sampled,
+		start:    time.Now(),
+	}
+	rand.Read(s.spanID[:])
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func spanFromContext(ctx context.Context) *span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+func (s *span) setAttr(key, value string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.attrs = append(s.attrs, spanAttr{key, value})
+	s.mu.Unlock()
+}
+
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+
+	if s.sampled {
+		s.tr.exp.export(s)
+	}
+}
+
+// traceparent returns the w3c traceparent header value for the span
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%x-%x-%s", s.traceID, s.spanID, flags)
+}
+
+// parseTraceparent reads a w3c traceparent header into a span
+// that's only used as the parent of the spans for a request
+func parseTraceparent(v string) (*span, bool) {
+	if len(v) != 55 || v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return nil, false
+	}
+
+	// version ff is invalid
+	if v[:2] == "ff" {
+		return nil, false
+	}
+
+	s := &span{}
+
+	if _, err := hex.Decode(s.traceID[:], []byte(v[3:35])); err != nil {
+		return nil, false
+	}
+
+	if _, err := hex.Decode(s.spanID[:], []byte(v[36:52])); err != nil {
+		return nil, false
+	}
+
+	if s.traceID == [16]byte{} || s.spanID == [8]byte{} {
+		return nil, false
+	}
+
+	flags, err := strconv.ParseUint(v[53:], 16, 8)
+	if err != nil {
+		return nil, false
+	}
+	s.sampled = flags&1 == 1
+
+	return s, true
+}
+
+// logExporter writes spans to the log, useful in development
+type logExporter struct {
+	log *zerolog.Logger
+}
+
+func (e *logExporter) export(s *span) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ev := e.log.Info().
+		Str("trace_id", hex.EncodeToString(s.traceID[:])).
+		Str("span_id", hex.EncodeToString(s.spanID[:])).
+		Str("parent_id", hex.EncodeToString(s.parentID[:])).
+		Dur("duration", s.end.Sub(s.start))
+
+	for _, a := range s.attrs {
+		ev = ev.Str(a.key, a.value)
+	}
+
+	if len(s.err) != 0 {
+		ev = ev.Str("error", s.err)
+	}
+
+	ev.Msg(s.name)
+}
+
+func (e *logExporter) close() {}
+
+// memoryExporter keeps the spans in memory, it's used in tests
+type memoryExporter struct {
+	sync.Mutex
+	spans []*span
+}
+
+func (e *memoryExporter) export(s *span) {
+	e.Lock()
+	e.spans = append(e.spans, s)
+	e.Unlock()
+}
+
+func (e *memoryExporter) close() {}
+
+func (e *memoryExporter) get() []*span {
+	e.Lock()
+	defer e.Unlock()
+
+	return append([]*span(nil), e.spans...)
+}
+
+// otlpExporter sends spans in batches to an OpenTelemetry collector
+// using the OTLP/HTTP json encoding
+type otlpExporter struct {
+	sync.Mutex
+	url     string
+	service string
+	client  *http.Client
+	spans   []*span
+	log     *zerolog.Logger
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newOTLPExporter(service, url string, log *zerolog.Logger) *otlpExporter {
+	e := &otlpExporter{
+		url:     url,
+		service: service,
+		client:  &http.Client{Timeout: defaultRemoteTimeout},
+		log:     log,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if len(e.url) == 0 {
+		e.url = defaultOTLPURL
+	}
+
+	go e.run()
+
+	return e
+}
+
+func (e *otlpExporter) run() {
+	t := time.NewTicker(otlpFlushInterval)
+	defer t.Stop()
+	defer close(e.done)
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-t.C:
+			e.flush()
+		}
+	}
+}
+
+func (e *otlpExporter) close() {
+	e.once.Do(func() {
+		close(e.stop)
+		<-e.done
+		e.flush()
+	})
+}
+
+func (e *otlpExporter) export(s *span) {
+	e.Lock()
+	e.spans = append(e.spans, s)
+	full := len(e.spans) >= otlpBatchSize
+	e.Unlock()
+
+	if full {
+		go e.flush()
+	}
+}
+
+func (e *otlpExporter) flush() {
+	e.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(otlpRequest(e.service, spans))
+	if err != nil {
+		e.log.Error().Err(err).Msg("telemetry: failed to encode spans")
+		return
+	}
+
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		e.log.Error().Err(err).Msg("telemetry: failed to export spans")
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 200 {
+		e.log.Error().Err(statusError(res.StatusCode)).Msg("telemetry: failed to export spans")
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Status       *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func otlpRequest(service string, spans []*span) interface{} {
+	list := make([]otlpSpan, len(spans))
+
+	for i, s := range spans {
+		s.mu.Lock()
+
+		list[i] = otlpSpan{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.spanID[:]),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+
+		if s.parentID != [8]byte{} {
+			list[i].ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+
+		for _, a := range s.attrs {
+			list[i].Attributes = append(list[i].Attributes, otlpAttr(a.key, a.value))
+		}
+
+		if len(s.err) != 0 {
+			list[i].Status = &otlpStatus{Code: 2, Message: s.err}
+		}
+
+		s.mu.Unlock()
+	}
+
+	type scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+
+	type resourceSpans struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+
+	ss := scopeSpans{Spans: list}
+	ss.Scope.Name = "super-graph"
+
+	rs := resourceSpans{ScopeSpans: []scopeSpans{ss}}
+	rs.Resource.Attributes = []otlpKeyValue{otlpAttr("service.name", service)}
+
+	return struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}{[]resourceSpans{rs}}
+}
+
+func otlpAttr(key, value string) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	kv.Value.StringValue = value
+	return kv
+}
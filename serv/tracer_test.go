@@ -0,0 +1,162 @@
+package serv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testTracer(t *testing.T) (*tracer, *memoryExporter) {
+	c := &Config{AppName: "test"}
+	c.Telemetry.Exporter = "memory"
+
+	tr, err := newTracer(c, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tr, tr.exp.(*memoryExporter)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		v       string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+
+	for _, v := range tests {
+		s, ok := parseTraceparent(v.v)
+		if ok != v.ok {
+			t.Errorf("%s: expecting %t got %t", v.v, v.ok, ok)
+			continue
+		}
+
+		if ok && s.sampled != v.sampled {
+			t.Errorf("%s: expecting sampled %t", v.v, v.sampled)
+		}
+
+		if ok && s.traceparent() != v.v {
+			t.Errorf("expecting %s got %s", v.v, s.traceparent())
+		}
+	}
+}
+
+func TestTraceSpans(t *testing.T) {
+	tr, exp := testTracer(t)
+
+	ctx, root := tr.startTrace(context.Background(),
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "graphql")
+
+	_, sp := startSpan(ctx, "db.query")
+	sp.setError(errors.New("failed"))
+	sp.finish()
+	root.finish()
+
+	spans := exp.get()
+	if len(spans) != 2 {
+		t.Fatalf("expecting 2 spans got %d", len(spans))
+	}
+
+	db, gql := spans[0], spans[1]
+
+	if gql.traceparent()[3:35] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expecting the trace to be continued got %s", gql.traceparent())
+	}
+
+	if gql.kind != spanServer || gql.parentID != [8]byte{0, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7} {
+		t.Error("expecting the root span to be a server span of the caller")
+	}
+
+	if db.parentID != gql.spanID || db.traceID != gql.traceID || db.err != "failed" {
+		t.Error("expecting the db span to be a failed child of the root span")
+	}
+
+	// not sampled by the caller
+	ctx, root = tr.startTrace(context.Background(),
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "graphql")
+	root.finish()
+
+	if len(exp.get()) != 2 {
+		t.Error("expecting spans that are not sampled to not be exported")
+	}
+
+	// no tracer
+	var ntr *tracer
+
+	ctx, root = ntr.startTrace(context.Background(), "", "graphql")
+	if _, sp := startSpan(ctx, "db.query"); root != nil || sp != nil {
+		t.Error("expecting no spans without a tracer")
+	}
+	root.finish()
+}
+
+func TestTraceRemote(t *testing.T) {
+	var got string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(traceparentHeader)
+		w.Write([]byte(`{"amount": 10}`))
+	}))
+	defer ts.Close()
+
+	tr, exp := testTracer(t)
+	ctx, root := tr.startTrace(context.Background(), "", "graphql")
+
+	rc := newRemoteClient(ConfigRemote{Name: "payments"}, testLog())
+
+	if _, err := rc.do(&remoteReq{ctx: ctx}, "GET", ts.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+	root.finish()
+
+	spans := exp.get()
+	if len(spans) != 2 || spans[0].name != "remote payments" || spans[0].kind != spanClient {
+		t.Fatalf("expecting a span for the remote call got %d spans", len(spans))
+	}
+
+	if got != spans[0].traceparent() {
+		t.Errorf("expecting the traceparent %s got %s", spans[0].traceparent(), got)
+	}
+}
+
+func TestOTLPRequest(t *testing.T) {
+	tr, exp := testTracer(t)
+
+	ctx, root := tr.startTrace(context.Background(), "", "graphql")
+	_, sp := startSpan(ctx, "db.query")
+	sp.setAttr("db.system", "postgresql")
+	sp.finish()
+	root.finish()
+
+	b, err := json.Marshal(otlpRequest("api", exp.get()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []string{
+		`"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}}]}`,
+		`"name":"db.query","kind":1`,
+		`"attributes":[{"key":"db.system","value":{"stringValue":"postgresql"}}]`,
+	} {
+		if !strings.Contains(string(b), v) {
+			t.Errorf("expecting %s in %s", v, b)
+		}
+	}
+
+	if strings.Count(string(b), `"parentSpanId"`) != 1 {
+		t.Errorf("expecting only the child span to have a parent in %s", b)
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
+	"strings"
 
 	"github.com/cespare/xxhash/v2"
+	"github.com/dosco/super-graph/qcode"
 )
 
 func mkkey(h *xxhash.Digest, k1 string, k2 string) uint64 {
@@ -17,6 +19,26 @@ func mkkey(h *xxhash.Digest, k1 string, k2 string) uint64 {
 	return v
 }
 
+func newQueryCost(qc *qcode.QCode, maxCost int) *queryCost {
+	if qc == nil || qc.Query == nil {
+		return nil
+	}
+
+	return &queryCost{
+		Cost:    qc.Query.Cost,
+		MaxCost: maxCost,
+		Depth:   qc.Query.Depth,
+		Selects: len(qc.Query.Selects),
+	}
+}
+
+// isQuery returns false for mutations and subscriptions, a bare
+// selection set is a query
+func isQuery(gql string) bool {
+	s := strings.TrimSpace(gql)
+	return !strings.HasPrefix(s, "mutation") && !strings.HasPrefix(s, "subscription")
+}
+
 func gqlHash(b []byte) string {
 	b = bytes.TrimSpace(b)
 	h := sha1.New()